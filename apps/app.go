@@ -5,13 +5,18 @@ import (
 )
 
 type HealthCheck struct {
-	Path                   string `json:"path"`
-	PortIndex              int    `json:"portIndex"`
-	Protocol               string `json:"protocol"`
-	GracePeriodSeconds     int    `json:"gracePeriodSeconds"`
-	IntervalSeconds        int    `json:"intervalSeconds"`
-	TimeoutSeconds         int    `json:"timeoutSeconds"`
-	MaxConsecutiveFailures int    `json:"maxConsecutiveFailures"`
+	Path                   string   `json:"path"`
+	PortIndex              int      `json:"portIndex"`
+	Command                *Command `json:"command"`
+	Protocol               string   `json:"protocol"`
+	GracePeriodSeconds     int      `json:"gracePeriodSeconds"`
+	IntervalSeconds        int      `json:"intervalSeconds"`
+	TimeoutSeconds         int      `json:"timeoutSeconds"`
+	MaxConsecutiveFailures int      `json:"maxConsecutiveFailures"`
+}
+
+type Command struct {
+	Value string `json:"value"`
 }
 
 type AppWrapper struct {
@@ -21,6 +26,8 @@ type AppWrapper struct {
 type App struct {
 	Labels       map[string]string `json:"labels"`
 	HealthChecks []HealthCheck     `json:"healthChecks"`
+	Constraints  [][]string        `json:"constraints"`
 	ID           string            `json:"id"`
+	Version      string            `json:"version"`
 	Tasks        []tasks.Task      `json:"tasks"`
 }
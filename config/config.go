@@ -7,6 +7,7 @@ import (
 	"github.com/allegro/marathon-consul/metrics"
 	"github.com/allegro/marathon-consul/sync"
 	flag "github.com/ogier/pflag"
+	"strings"
 	"time"
 )
 
@@ -27,11 +28,23 @@ func New() (config *Config) {
 	}
 	config.parseFlags()
 	config.setLogLevel()
+	config.validate()
 
 	return config
 }
 
+// Copy of configuration safe to expose for diagnostics, with secrets redacted
+func (config Config) Redacted() Config {
+	config.Consul = config.Consul.Redacted()
+	if config.Marathon.Password != "" {
+		config.Marathon.Password = consul.Redacted
+	}
+	return config
+}
+
 func (config *Config) parseFlags() {
+	var bootstrapAgents, allowedHealthChecks, tagsPerDatacenter, checkTimeouts, tagFromConstraints, metaFromLabels, datacenters, excludeDatacenters string
+
 	// Consul
 	flag.BoolVar(&config.Consul.Enabled, "consul", true, "Use Consul backend")
 	flag.StringVar(&config.Consul.Port, "consul-port", "8500", "Consul port")
@@ -40,9 +53,60 @@ func (config *Config) parseFlags() {
 	flag.StringVar(&config.Consul.Auth.Password, "consul-auth-password", "", "The basic authentication password")
 	flag.BoolVar(&config.Consul.SslEnabled, "consul-ssl", false, "Use HTTPS when talking to Consul")
 	flag.BoolVar(&config.Consul.SslVerify, "consul-ssl-verify", true, "Verify certificates when connecting via SSL")
+	flag.DurationVar(&config.Consul.DatacentersCacheTTL, "consul-datacenters-cache-ttl", 0, "How long datacenters list is reused before it is fetched again (0 fetches on every query)")
+	flag.IntVar(&config.Consul.ReadRetries, "consul-read-retries", 0, "Number of retries of failed catalog and health reads (0 disables)")
+	flag.DurationVar(&config.Consul.ReadRetryBackoff, "consul-read-retry-backoff", 100*time.Millisecond, "Backoff before first retry of failed read")
+	flag.Float64Var(&config.Consul.ReadRetryBackoffMultiplier, "consul-read-retry-backoff-multiplier", 2, "Multiplier of read retry backoff applied with every retry")
+	flag.DurationVar(&config.Consul.ReadRetryMaxBackoff, "consul-read-retry-max-backoff", 0, "Maximum backoff between read retries (0 is no limit)")
+	flag.IntVar(&config.Consul.RateLimitRetries, "consul-rate-limit-retries", 3, "Number of retries of writes rate limited by Consul (HTTP 429)")
+	flag.DurationVar(&config.Consul.RateLimitBackoff, "consul-rate-limit-backoff", time.Second, "Backoff before first retry of rate limited write, doubled with every retry")
+	flag.IntVar(&config.Consul.MaxIdleConnsPerHost, "consul-max-idle-conns-per-host", 0, "Idle keep-alive connections kept per agent (0 uses Go default)")
+	flag.DurationVar(&config.Consul.IdleConnTimeout, "consul-idle-conn-timeout", 0, "How long idle agent connections are kept open (0 means no limit)")
 	flag.StringVar(&config.Consul.SslCert, "consul-ssl-cert", "", "Path to an SSL client certificate to use to authenticate to the Consul server")
 	flag.StringVar(&config.Consul.SslCaCert, "consul-ssl-ca-cert", "", "Path to a CA certificate file, containing one or more CA certificates to use to validate the certificate sent by the Consul server to us")
 	flag.StringVar(&config.Consul.Token, "consul-token", "", "The Consul ACL token")
+	flag.StringVar(&config.Consul.TokenFile, "consul-token-file", "", "File the Consul ACL token is read from, used instead of consul-token")
+	flag.BoolVar(&config.Consul.BestEffortDCQueries, "consul-best-effort-dc-queries", false, "Return services from datacenters that responded instead of failing when any of them fails")
+	flag.StringVar(&config.Consul.CheckShell, "consul-check-shell", "", "Shell running COMMAND health checks, e.g. /bin/sh (COMMAND checks are skipped when empty)")
+	flag.StringVar(&bootstrapAgents, "consul-bootstrap-agents", "", "Comma separated list of Consul agents used when no other agent is known")
+	flag.IntVar(&config.Consul.CatalogFetchConcurrency, "consul-catalog-fetch-concurrency", 1, "Number of services whose instances or health are fetched from Consul at once")
+	flag.StringVar(&config.Consul.DefaultTagWhenNone, "consul-default-tag", "", "Tag added to services of apps without tag labels")
+	flag.IntVar(&config.Consul.ServiceNameSegments, "consul-service-name-segments", 0, "Number of last Marathon app ID segments used as service name (0 uses all)")
+	flag.DurationVar(&config.Consul.RegistrationRefreshInterval, "consul-registration-refresh-interval", 0, "Interval of re-registering services missing from their Consul agents (0 disables)")
+	flag.IntVar(&config.Consul.MaxManagedServices, "consul-max-managed-services", 0, "Number of managed services above which a warning is logged and consul.catalog.over_threshold metric is marked (0 disables)")
+	flag.IntVar(&config.Consul.MaxServicesPerAgent, "consul-max-services-per-agent", 0, "Number of services registered in one agent above which new registrations in it are refused and consul.register.agent_full metric is marked (0 disables)")
+	flag.StringVar(&tagsPerDatacenter, "consul-tags-per-datacenter", "", "Comma separated list of datacenter:tag1;tag2 entries, tags are added to services registered in given datacenter")
+	flag.IntVar(&config.Consul.CheckFailuresBeforeWarning, "consul-check-failures-before-warning", 0, "Consecutive check failures before service turns warning (0 omits it)")
+	flag.StringVar(&config.Consul.CheckInitialStatus, "consul-check-initial-status", "", "Status of checks until their first run: passing, warning or critical (default Consul default, critical)")
+	flag.StringVar(&datacenters, "consul-datacenters", "", "Comma separated list of datacenters queried (default all)")
+	flag.StringVar(&excludeDatacenters, "consul-exclude-datacenters", "", "Comma separated list of datacenters never queried")
+	flag.StringVar(&config.Consul.AgentSelectionStrategy, "consul-agent-selection-strategy", consul.AgentSelectionRandom, "How reads pick an agent from the pool: random or round-robin")
+	flag.StringVar(&config.Consul.EmptyDatacenterBehavior, "consul-empty-datacenter-behavior", consul.EmptyDatacentersError, "What to do when Consul returns no datacenters: error or default (query agent datacenter)")
+	flag.BoolVar(&config.Consul.UseAgentAddress, "consul-use-agent-address", false, "Register services without address so Consul uses address of agent node")
+	flag.StringVar(&checkTimeouts, "consul-check-timeouts", "", "Comma separated list of protocol:timeout entries overriding Marathon check timeouts, e.g. TCP:1s")
+	flag.BoolVar(&config.Consul.VerifyNodeBeforeRegister, "consul-verify-node-before-register", false, "Register services only in agents whose node is present and not critical in Consul catalog")
+	flag.StringVar(&config.Consul.Partition, "consul-partition", "", "Consul Enterprise admin partition services are registered in and read from (apps may override it with consul.partition label)")
+	flag.BoolVar(&config.Consul.NodeAliasCheck, "consul-node-alias-check", false, "Add check aliasing agent node health to services so node failure marks them critical immediately")
+	flag.BoolVar(&config.Consul.CheckTLSSkipVerify, "consul-check-tls-skip-verify", false, "Do not verify certificates of HTTPS checks (apps may override it with consul.check.tlsSkipVerify label)")
+	flag.BoolVar(&config.Consul.CatalogDeregisterFallback, "consul-catalog-deregister-fallback", false, "Deregister services from catalog when agent they were registered in can not be reached")
+	flag.StringVar(&config.Consul.OnServiceNameCollision, "consul-service-name-collision", consul.NameCollisionMerge, "What to do when different apps derive the same service name: merge, suffix-app-id or error")
+	flag.DurationVar(&config.Consul.DeregisterCriticalServiceAfter, "consul-deregister-critical-service-after", 0, "Critical time after which Consul deregisters services, at least 1m (0 disables)")
+	flag.DurationVar(&config.Consul.ShortLivedCheckInterval, "consul-short-lived-check-interval", 5*time.Second, "Check interval of services of apps labeled as short-lived")
+	flag.DurationVar(&config.Consul.ShortLivedDeregisterAfter, "consul-short-lived-deregister-after", time.Minute, "Critical time after which Consul deregisters services of apps labeled as short-lived")
+	flag.DurationVar(&config.Consul.MarathonHealthCheckTTL, "consul-marathon-health-check-ttl", 0, "TTL of check mirroring Marathon task health, it should be longer than sync-interval (0 disables)")
+	flag.StringVar(&config.Consul.ServiceIdTemplate, "consul-service-id-template", "", "Go template of service IDs with .TaskID, .AppID, .Name, .Host, .Port and .Task fields (default task ID)")
+	flag.StringVar(&config.Consul.LabelPrefix, "consul-label-prefix", consul.DefaultLabelPrefix, "Prefix of app labels read by marathon-consul")
+	flag.StringVar(&config.Consul.AddressSelection, "consul-address-selection", "", "Resolve task host to IPv4 picking first, last, prefer-private or prefer-public address (host is used as is when empty)")
+	flag.StringVar(&allowedHealthChecks, "consul-allowed-health-checks", "", "Comma separated list of health check protocols translated to Consul checks: HTTP, HTTPS, TCP, COMMAND (default HTTP only)")
+	flag.StringVar(&metaFromLabels, "consul-meta-from-labels", "", "Comma separated list of app labels copied to service meta")
+	flag.StringVar(&tagFromConstraints, "consul-tag-from-constraints", "", "Comma separated list of constraint fields, e.g. rack_id, whose app constraints are added as service tags")
+	flag.IntVar(&config.Consul.DeregisterCriticalAfterObservations, "consul-deregister-critical-observations", 0, "Deregister services observed critical given number of times in a row (0 disables)")
+	flag.DurationVar(&config.Consul.CriticalWatchInterval, "consul-critical-watch-interval", time.Minute, "Interval of checking health of registered services")
+	flag.IntVar(&config.Consul.WeightDecaySteps, "consul-weight-decay-steps", 0, "Number of failing health observations in a row lowering service weight to minimum (0 disables)")
+	flag.IntVar(&config.Consul.DeregisterWeightRampSteps, "consul-deregister-weight-ramp-steps", 0, "Number of steps service weight is lowered in before deregistration (0 disables)")
+	flag.DurationVar(&config.Consul.DeregisterWeightRampDuration, "consul-deregister-weight-ramp-duration", 10*time.Second, "Time spent lowering service weight before deregistration")
+	flag.StringVar(&config.Consul.MetricsAppLabel, "consul-metrics-app-label", "", "App label grouping per-app register/deregister metrics, id groups by Marathon app ID (empty disables)")
+	flag.StringVar(&config.Consul.EventsWebhook, "consul-events-webhook", "", "URL receiving JSON events about registered and deregistered services")
 
 	// Web
 	flag.StringVar(&config.Web.Listen, "listen", ":4000", "accept connections at this address")
@@ -66,6 +130,70 @@ func (config *Config) parseFlags() {
 	flag.StringVar(&config.LogLevel, "log-level", "info", "Log level: panic, fatal, error, warn, info, or debug")
 
 	flag.Parse()
+
+	config.Consul.BootstrapAgents = splitList(bootstrapAgents)
+	config.Consul.AllowedHealthChecks = splitList(strings.ToUpper(allowedHealthChecks))
+	config.Consul.TagFromConstraints = splitList(tagFromConstraints)
+	config.Consul.MetaFromLabels = splitList(metaFromLabels)
+	config.Consul.Datacenters = splitList(datacenters)
+	config.Consul.ExcludeDatacenters = splitList(excludeDatacenters)
+	config.Consul.TagsPerDatacenter = parseTagsPerDatacenter(tagsPerDatacenter)
+	config.Consul.CheckTimeoutByProtocol = parseCheckTimeouts(strings.ToUpper(checkTimeouts))
+	if config.Consul.TokenFile != "" {
+		token, err := consul.ReadTokenFile(config.Consul.TokenFile)
+		if err != nil {
+			log.WithError(err).Fatal("unable to read Consul ACL token")
+		}
+		config.Consul.Token = token
+	}
+}
+
+func parseCheckTimeouts(value string) map[string]time.Duration {
+	timeouts := make(map[string]time.Duration)
+	for _, entry := range splitList(value) {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			log.WithField("entry", entry).Fatal("bad check timeout, expected protocol:timeout")
+		}
+		timeout, err := time.ParseDuration(strings.ToLower(parts[1]))
+		if err != nil {
+			log.WithError(err).WithField("entry", entry).Fatal("bad check timeout")
+		}
+		timeouts[parts[0]] = timeout
+	}
+	return timeouts
+}
+
+func parseTagsPerDatacenter(value string) map[string][]string {
+	tagsPerDatacenter := make(map[string][]string)
+	for _, entry := range splitList(value) {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			log.WithField("entry", entry).Fatal("bad datacenter tags, expected datacenter:tag1;tag2")
+		}
+		for _, tag := range strings.Split(parts[1], ";") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tagsPerDatacenter[parts[0]] = append(tagsPerDatacenter[parts[0]], tag)
+			}
+		}
+	}
+	return tagsPerDatacenter
+}
+
+func splitList(list string) []string {
+	var elements []string
+	for _, element := range strings.Split(list, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
+
+func (config *Config) validate() {
+	if err := config.Consul.Validate(); err != nil {
+		log.WithError(err).Fatal("bad consul config")
+	}
 }
 
 func (config *Config) setLogLevel() {
@@ -2,13 +2,21 @@ package consul
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"github.com/allegro/marathon-consul/metrics"
 	consulapi "github.com/hashicorp/consul/api"
+	"math/rand"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
 	"sync"
 )
 
+var ErrNoAgentAvailable = errors.New("No agent available")
+
 type Agents interface {
 	GetAgent(string) (*consulapi.Client, error)
 	GetAnyAgent() (*consulapi.Client, error)
@@ -18,6 +26,8 @@ type ConcurrentAgents struct {
 	agents map[string]*consulapi.Client
 	config *ConsulConfig
 	lock   sync.Mutex
+	// Position of the last agent picked with round-robin strategy
+	next int
 }
 
 func NewAgents(config *ConsulConfig) *ConcurrentAgents {
@@ -31,16 +41,52 @@ func (a *ConcurrentAgents) GetAnyAgent() (*consulapi.Client, error) {
 	a.lock.Lock()
 	defer a.lock.Unlock()
 
-	for _, agent := range a.agents {
-		return agent, nil
+	if len(a.agents) == 0 {
+		a.seedFromBootstrapAgents()
+	}
+
+	if len(a.agents) == 0 {
+		metrics.Mark("consul.agents.exhausted")
+		return nil, ErrNoAgentAvailable
+	}
+
+	address := a.selectAgent()
+	markAgentOperation(address)
+	return a.agents[address], nil
+}
+
+// Picks address of pooled agent with configured strategy, pool must not be empty
+func (a *ConcurrentAgents) selectAgent() string {
+	addresses := make([]string, 0, len(a.agents))
+	for address := range a.agents {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	if a.config.AgentSelectionStrategy == AgentSelectionRoundRobin {
+		a.next = (a.next + 1) % len(addresses)
+		return addresses[a.next]
+	}
+	return addresses[rand.Intn(len(addresses))]
+}
+
+func (a *ConcurrentAgents) seedFromBootstrapAgents() {
+	for _, agentAddress := range a.config.BootstrapAgents {
+		agent, err := a.createAgent(agentAddress)
+		if err != nil {
+			log.WithError(err).WithField("Address", agentAddress).Warn("Unable to create bootstrap agent")
+			continue
+		}
+		log.WithField("Address", agentAddress).Info("Seeding agents pool with bootstrap agent")
+		a.addAgent(agentAddress, agent)
 	}
-	return nil, fmt.Errorf("No agent available")
 }
 
 func (a *ConcurrentAgents) GetAgent(agentAddress string) (*consulapi.Client, error) {
 	a.lock.Lock()
 	defer a.lock.Unlock()
 	if agent, ok := a.agents[agentAddress]; ok {
+		markAgentOperation(agentAddress)
 		return agent, nil
 	}
 
@@ -49,9 +95,15 @@ func (a *ConcurrentAgents) GetAgent(agentAddress string) (*consulapi.Client, err
 		return nil, err
 	}
 	a.addAgent(agentAddress, newAgent)
+	markAgentOperation(agentAddress)
 	return newAgent, nil
 }
 
+// Counts agent selections per agent to show how load is distributed
+func markAgentOperation(address string) {
+	metrics.Mark("consul.agent.ops." + metricNameReplacer.Replace(address))
+}
+
 func (a *ConcurrentAgents) addAgent(agentAddress string, agent *consulapi.Client) {
 	a.agents[agentAddress] = agent
 }
@@ -62,11 +114,14 @@ func (a *ConcurrentAgents) createAgent(address string) (*consulapi.Client, error
 	}
 	config := consulapi.DefaultConfig()
 
-	config.Address = fmt.Sprintf("%s:%s", address, a.config.Port)
+	config.Address = address
+	if !hasPort(address) {
+		config.Address = fmt.Sprintf("%s:%s", address, a.config.Port)
+	}
 	log.Debugf("consul address: %s", config.Address)
 
 	if a.config.Token != "" {
-		log.Debugf("setting token to %s", a.config.Token)
+		log.Debugf("setting token")
 		config.Token = a.config.Token
 	}
 
@@ -75,13 +130,8 @@ func (a *ConcurrentAgents) createAgent(address string) (*consulapi.Client, error
 		config.Scheme = "https"
 	}
 
-	if !a.config.SslVerify {
-		log.Debugf("disabled SSL verification")
-		config.HttpClient.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		}
+	if transport := agentTransport(a.config); transport != nil {
+		config.HttpClient.Transport = transport
 	}
 
 	if a.config.Auth.Enabled {
@@ -94,3 +144,32 @@ func (a *ConcurrentAgents) createAgent(address string) (*consulapi.Client, error
 
 	return consulapi.NewClient(config)
 }
+
+// Transport tuned with configured connection pooling and SSL verification,
+// nil when defaults should be used
+func agentTransport(config *ConsulConfig) *http.Transport {
+	if config.SslVerify && config.MaxIdleConnsPerHost == 0 && config.IdleConnTimeout == 0 {
+		return nil
+	}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: config.MaxIdleConnsPerHost,
+		IdleConnTimeout:     config.IdleConnTimeout,
+	}
+	if !config.SslVerify {
+		log.Debugf("disabled SSL verification")
+		transport.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: true,
+		}
+	}
+	return transport
+}
+
+func hasPort(address string) bool {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	_, err = strconv.Atoi(port)
+	return err == nil
+}
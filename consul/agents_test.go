@@ -3,6 +3,7 @@ package consul
 import (
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestGetAgent(t *testing.T) {
@@ -29,3 +30,138 @@ func TestGetAnyAgent(t *testing.T) {
 	// then
 	assert.Equal(t, agent1, agent2)
 }
+
+func TestGetAnyAgentSeedsEmptyPoolFromBootstrapAgents(t *testing.T) {
+	t.Parallel()
+	// given
+	agents := NewAgents(&ConsulConfig{BootstrapAgents: []string{"127.0.0.1"}})
+
+	// when
+	agent, err := agents.GetAnyAgent()
+
+	// then
+	assert.NoError(t, err)
+	assert.NotNil(t, agent)
+	assert.Len(t, agents.agents, 1)
+}
+
+func TestGetAnyAgentWithoutBootstrapAgents(t *testing.T) {
+	t.Parallel()
+	// given
+	agents := NewAgents(&ConsulConfig{})
+
+	// when
+	agent, err := agents.GetAnyAgent()
+
+	// then
+	assert.Error(t, err)
+	assert.Nil(t, agent)
+}
+
+func TestGetAnyAgentFromEmptyPoolMarksExhaustion(t *testing.T) {
+	t.Parallel()
+	// given
+	agents := NewAgents(&ConsulConfig{})
+	exhausted := meterCount("consul.agents.exhausted")
+
+	// when
+	agent, err := agents.GetAnyAgent()
+
+	// then
+	assert.Nil(t, agent)
+	assert.Equal(t, ErrNoAgentAvailable, err)
+	assert.True(t, meterCount("consul.agents.exhausted") > exhausted)
+}
+
+func TestGetAnyAgentWithRoundRobinStrategy(t *testing.T) {
+	t.Parallel()
+	// given
+	agents := NewAgents(&ConsulConfig{AgentSelectionStrategy: AgentSelectionRoundRobin})
+	agent1, _ := agents.GetAgent("127.0.0.1:8500")
+	agent2, _ := agents.GetAgent("127.0.0.2:8500")
+
+	// when
+	first, _ := agents.GetAnyAgent()
+	second, _ := agents.GetAnyAgent()
+	third, _ := agents.GetAnyAgent()
+
+	// then
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, first, third)
+	assert.Contains(t, []interface{}{agent1, agent2}, first)
+	assert.Contains(t, []interface{}{agent1, agent2}, second)
+}
+
+func TestGetAnyAgentWithRandomStrategyPicksPooledAgent(t *testing.T) {
+	t.Parallel()
+	// given
+	agents := NewAgents(&ConsulConfig{AgentSelectionStrategy: AgentSelectionRandom})
+	agent1, _ := agents.GetAgent("127.0.0.1:8500")
+	agent2, _ := agents.GetAgent("127.0.0.2:8500")
+
+	// when
+	agent, err := agents.GetAnyAgent()
+
+	// then
+	assert.NoError(t, err)
+	assert.Contains(t, []interface{}{agent1, agent2}, agent)
+}
+
+func TestHasPort(t *testing.T) {
+	t.Parallel()
+	assert.True(t, hasPort("127.0.0.1:8500"))
+	assert.True(t, hasPort("[::1]:8500"))
+	assert.False(t, hasPort("127.0.0.1"))
+	assert.False(t, hasPort("http://127.0.0.1"))
+}
+
+func TestSelectingAgentMarksAgentOperation(t *testing.T) {
+	t.Parallel()
+	// given
+	agents := NewAgents(&ConsulConfig{})
+	ops := meterCount("consul.agent.ops.127_0_0_2")
+
+	// when
+	agents.GetAgent("127.0.0.2")
+	agents.GetAgent("127.0.0.2")
+	agents.GetAnyAgent()
+
+	// then
+	assert.Equal(t, ops+3, meterCount("consul.agent.ops.127_0_0_2"))
+}
+
+func TestAgentTransportUsesDefaultsWhenNotConfigured(t *testing.T) {
+	t.Parallel()
+	// given
+	config := &ConsulConfig{SslVerify: true}
+
+	// then
+	assert.Nil(t, agentTransport(config))
+}
+
+func TestAgentTransportIsConfiguredWithConnectionPooling(t *testing.T) {
+	t.Parallel()
+	// given
+	config := &ConsulConfig{SslVerify: true, MaxIdleConnsPerHost: 32, IdleConnTimeout: 90 * time.Second}
+
+	// when
+	transport := agentTransport(config)
+
+	// then
+	assert.Equal(t, 32, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 90*time.Second, transport.IdleConnTimeout)
+	assert.Nil(t, transport.TLSClientConfig)
+}
+
+func TestAgentTransportKeepsPoolingWithSslVerificationDisabled(t *testing.T) {
+	t.Parallel()
+	// given
+	config := &ConsulConfig{SslVerify: false, MaxIdleConnsPerHost: 8}
+
+	// when
+	transport := agentTransport(config)
+
+	// then
+	assert.Equal(t, 8, transport.MaxIdleConnsPerHost)
+	assert.True(t, transport.TLSClientConfig.InsecureSkipVerify)
+}
@@ -0,0 +1,84 @@
+package consul
+
+import (
+	"github.com/allegro/marathon-consul/apps"
+	"github.com/allegro/marathon-consul/metrics"
+	"strings"
+	"sync"
+)
+
+const metricsAppIdLabel = "id"
+
+var metricNameReplacer = strings.NewReplacer(".", "_", ":", "_", "/", "_", " ", "_")
+
+// Groups register/deregister metrics by the configured app label.
+// Only one label is used to keep the number of metrics bounded.
+type appMetrics struct {
+	label  string
+	groups map[string]string
+	lock   sync.Mutex
+}
+
+func newAppMetrics(label string) *appMetrics {
+	return &appMetrics{
+		label:  label,
+		groups: make(map[string]string),
+	}
+}
+
+func (m *appMetrics) enabled() bool {
+	return m.label != ""
+}
+
+func (m *appMetrics) group(app *apps.App) string {
+	value := app.Labels[m.label]
+	if m.label == metricsAppIdLabel {
+		value = app.ID
+	}
+	value = metricNameReplacer.Replace(strings.Trim(value, "/"))
+	if value == "" {
+		return "other"
+	}
+	return strings.ToLower(value)
+}
+
+// Unchanged registrations are marked apart from successful ones, so success rate counts only writes
+func (m *appMetrics) markRegister(serviceId string, app *apps.App, registerOutcome RegisterOutcome) {
+	if !m.enabled() {
+		return
+	}
+	group := m.group(app)
+	m.lock.Lock()
+	m.groups[serviceId] = group
+	m.lock.Unlock()
+	result := "success"
+	switch registerOutcome {
+	case RegistrationFailed:
+		result = "error"
+	case RegistrationUnchanged:
+		result = "unchanged"
+	}
+	metrics.Mark("consul.register.app." + group + "." + result)
+}
+
+func (m *appMetrics) markDeregister(serviceId string, err error) {
+	if !m.enabled() {
+		return
+	}
+	m.lock.Lock()
+	group, ok := m.groups[serviceId]
+	if ok && err == nil {
+		delete(m.groups, serviceId)
+	}
+	m.lock.Unlock()
+	if ok {
+		metrics.Mark("consul.deregister.app." + group + "." + outcome(err))
+	}
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
@@ -0,0 +1,65 @@
+package consul
+
+import (
+	"github.com/allegro/marathon-consul/apps"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func meterCount(name string) int64 {
+	return metrics.GetOrRegisterMeter(name, metrics.DefaultRegistry).Count()
+}
+
+func TestAppMetricsGroupedByLabel(t *testing.T) {
+	t.Parallel()
+	// given
+	appMetrics := newAppMetrics("team")
+	app := &apps.App{ID: "/payments/api", Labels: map[string]string{"team": "Payments"}}
+
+	registered := meterCount("consul.register.app.payments.success")
+	failed := meterCount("consul.register.app.payments.error")
+	unchanged := meterCount("consul.register.app.payments.unchanged")
+	deregistered := meterCount("consul.deregister.app.payments.success")
+
+	// when
+	appMetrics.markRegister("api.1", app, Registered)
+	appMetrics.markRegister("api.2", app, RegistrationFailed)
+	appMetrics.markRegister("api.1", app, RegistrationUnchanged)
+	appMetrics.markDeregister("api.1", nil)
+
+	// then
+	assert.Equal(t, registered+1, meterCount("consul.register.app.payments.success"))
+	assert.Equal(t, failed+1, meterCount("consul.register.app.payments.error"))
+	assert.Equal(t, unchanged+1, meterCount("consul.register.app.payments.unchanged"))
+	assert.Equal(t, deregistered+1, meterCount("consul.deregister.app.payments.success"))
+}
+
+func TestAppMetricsGroupedByAppId(t *testing.T) {
+	t.Parallel()
+	// given
+	appMetrics := newAppMetrics(metricsAppIdLabel)
+	app := &apps.App{ID: "/search/indexer"}
+
+	registered := meterCount("consul.register.app.search_indexer.success")
+
+	// when
+	appMetrics.markRegister("indexer.1", app, Registered)
+
+	// then
+	assert.Equal(t, registered+1, meterCount("consul.register.app.search_indexer.success"))
+}
+
+func TestAppMetricsDisabled(t *testing.T) {
+	t.Parallel()
+	// given
+	appMetrics := newAppMetrics("")
+	app := &apps.App{ID: "/disabled/app", Labels: map[string]string{"team": "disabled"}}
+
+	// when
+	appMetrics.markRegister("app.1", app, Registered)
+
+	// then
+	assert.Empty(t, appMetrics.groups)
+	assert.Nil(t, metrics.DefaultRegistry.Get("consul.register.app.disabled_app.success"))
+}
@@ -1,5 +1,16 @@
 package consul
 
+import (
+	"fmt"
+	"github.com/allegro/marathon-consul/tasks"
+	"github.com/allegro/marathon-consul/utils"
+	consulapi "github.com/hashicorp/consul/api"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+)
+
 type ConsulConfig struct {
 	Enabled    bool
 	Auth       Auth
@@ -9,6 +20,143 @@ type ConsulConfig struct {
 	SslCert    string
 	SslCaCert  string
 	Token      string
+	// File ACL token is read from instead of Token
+	TokenFile string
+	// Idle keep-alive connections kept per agent, Go default when not set
+	MaxIdleConnsPerHost int
+	// How long idle agent connections are kept open, forever when not set
+	IdleConnTimeout time.Duration
+	// Agents used to seed the pool whenever it is empty
+	BootstrapAgents []string
+	EventsWebhook   string
+	// When set only checks with listed protocols are translated
+	AllowedHealthChecks []string
+	// Number of steps service weight is lowered in before deregistration
+	DeregisterWeightRampSteps    int
+	DeregisterWeightRampDuration time.Duration
+	// Return services from datacenters that responded instead of failing when any of them fails
+	BestEffortDCQueries bool
+	// Deregister services observed critical given number of times in a row (0 disables)
+	DeregisterCriticalAfterObservations int
+	CriticalWatchInterval               time.Duration
+	// Number of failing observations in a row lowering service weight to minimum (0 disables)
+	WeightDecaySteps int
+	// Re-register services missing from their agents in this interval (0 disables)
+	RegistrationRefreshInterval time.Duration
+	// Number of services registered by this instance in one agent above which
+	// new registrations in it are refused (0 disables)
+	MaxServicesPerAgent int
+	// Number of managed services above which warning is raised (0 disables)
+	MaxManagedServices int
+	// Tags added to services registered in agents of given datacenter
+	TagsPerDatacenter map[string][]string
+	// Datacenters queried, all when empty, and datacenters never queried
+	Datacenters        []string
+	ExcludeDatacenters []string
+	// What to do when Consul returns no datacenters, fail or query agent datacenter
+	EmptyDatacenterBehavior string
+	// How long datacenters list is reused before it is fetched again, last known list
+	// is used when fetching fails (0 fetches on every query)
+	DatacentersCacheTTL time.Duration
+	// Retries of failed catalog and health reads, backoff is multiplied with every retry
+	// up to max backoff (0 is no limit)
+	ReadRetries                int
+	ReadRetryBackoff           time.Duration
+	ReadRetryBackoffMultiplier float64
+	ReadRetryMaxBackoff        time.Duration
+	// Retries of writes rate limited by Consul, backoff doubles with every retry
+	RateLimitRetries int
+	RateLimitBackoff time.Duration
+	// Deregister services from catalog when agent they were registered in can not be reached
+	CatalogDeregisterFallback bool
+	// App label grouping per-app metrics, "id" groups by app ID
+	MetricsAppLabel string
+	// How reads pick an agent from the pool, random when empty
+	AgentSelectionStrategy string
+	// Status of translated checks until their first run, Consul default (critical) when empty
+	CheckInitialStatus string
+	// Consecutive check failures before service turns warning
+	CheckFailuresBeforeWarning int
+	// Check timeouts used instead of Marathon ones for given protocols
+	CheckTimeoutByProtocol map[string]time.Duration
+	// Critical time after which Consul deregisters services, so they do not linger
+	// when deregistration is missed (0 disables)
+	DeregisterCriticalServiceAfter time.Duration
+	// Check interval and critical time after which Consul deregisters services of short-lived tasks
+	ShortLivedCheckInterval   time.Duration
+	ShortLivedDeregisterAfter time.Duration
+	// Do not verify certificates of HTTPS checks unless app label says otherwise
+	CheckTLSSkipVerify bool
+	// TTL of check mirroring Marathon task health, refreshed on every sync and health event (0 disables)
+	MarathonHealthCheckTTL time.Duration
+	// Shell running COMMAND checks, they are not translated when empty
+	CheckShell string
+	// How task host resolving to many addresses is turned into service address,
+	// host is used as is when empty
+	AddressSelection string
+	// Number of services instances fetched from catalog at once, sequentially when not set
+	CatalogFetchConcurrency int
+	// App labels copied to service meta
+	MetaFromLabels []string
+	// Fields of app constraints turned into tags
+	TagFromConstraints []string
+	// Tag added to services of apps without tag labels
+	DefaultTagWhenNone string
+	// Number of last app ID segments used as service name, all when not set
+	ServiceNameSegments int
+	// Register services without address so Consul uses agent node address
+	UseAgentAddress bool
+	// Register services only in agents whose node is healthy in catalog
+	VerifyNodeBeforeRegister bool
+	// Consul Enterprise admin partition services are registered in and read from
+	Partition string
+	// Add check aliasing agent node health to services
+	NodeAliasCheck bool
+	// What to do when different apps derive the same service name, instances are merged when not set
+	OnServiceNameCollision string
+	// Go template of service IDs evaluated with .TaskID, .AppID, .Name, .Host and .Port,
+	// task ID is used when empty
+	ServiceIdTemplate string
+	// Prefix of app labels read by marathon-consul, "consul" when empty
+	LabelPrefix string
+}
+
+const DefaultLabelPrefix = "consul"
+
+const (
+	EmptyDatacentersError   = "error"
+	EmptyDatacentersDefault = "default"
+)
+
+const (
+	NameCollisionMerge       = "merge"
+	NameCollisionSuffixAppId = "suffix-app-id"
+	NameCollisionError       = "error"
+)
+
+var NameCollisionBehaviors = []string{NameCollisionMerge, NameCollisionSuffixAppId, NameCollisionError}
+
+const (
+	AgentSelectionRandom     = "random"
+	AgentSelectionRoundRobin = "round-robin"
+)
+
+var AgentSelectionStrategies = []string{AgentSelectionRandom, AgentSelectionRoundRobin}
+
+var EmptyDatacenterBehaviors = []string{EmptyDatacentersError, EmptyDatacentersDefault}
+
+var CheckInitialStatuses = []string{consulapi.HealthPassing, consulapi.HealthWarning, consulapi.HealthCritical}
+
+// Returns app label key with configured prefix, the prefix itself for empty name
+func (config *ConsulConfig) label(name string) string {
+	prefix := config.LabelPrefix
+	if prefix == "" {
+		prefix = DefaultLabelPrefix
+	}
+	if name == "" {
+		return prefix
+	}
+	return prefix + "." + name
 }
 
 type Auth struct {
@@ -16,3 +164,136 @@ type Auth struct {
 	Username string
 	Password string
 }
+
+// Reads ACL token from file, surrounding whitespace (e.g. trailing newline) is dropped
+func ReadTokenFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("Token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// Placeholder replacing secrets in configuration exposed for diagnostics
+const Redacted = "<redacted>"
+
+// Copy of configuration safe to show, with token and password redacted
+func (config ConsulConfig) Redacted() ConsulConfig {
+	config.Token = redact(config.Token)
+	config.Auth.Password = redact(config.Auth.Password)
+	config.EventsWebhook = redactUrl(config.EventsWebhook)
+	return config
+}
+
+// Strips user info and query that may carry credentials, URLs that do not parse are redacted whole
+func redactUrl(rawUrl string) string {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return redact(rawUrl)
+	}
+	parsed.User = nil
+	parsed.RawQuery = ""
+	return parsed.String()
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return Redacted
+}
+
+func (config *ConsulConfig) Validate() error {
+	for _, protocol := range config.AllowedHealthChecks {
+		if !contains(SupportedHealthChecks, protocol) {
+			return fmt.Errorf("Unsupported health check protocol %s, expected one of %v", protocol, SupportedHealthChecks)
+		}
+	}
+	for protocol, timeout := range config.CheckTimeoutByProtocol {
+		if !contains(SupportedHealthChecks, protocol) {
+			return fmt.Errorf("Unsupported health check protocol %s, expected one of %v", protocol, SupportedHealthChecks)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("Check timeout for %s must be positive", protocol)
+		}
+	}
+	if config.AddressSelection != "" && !contains(utils.AddressSelections, config.AddressSelection) {
+		return fmt.Errorf("Unknown address selection %s, expected one of %v", config.AddressSelection, utils.AddressSelections)
+	}
+	if config.OnServiceNameCollision != "" && !contains(NameCollisionBehaviors, config.OnServiceNameCollision) {
+		return fmt.Errorf("Unknown service name collision behavior %s, expected one of %v", config.OnServiceNameCollision, NameCollisionBehaviors)
+	}
+	if config.ServiceIdTemplate != "" {
+		sample := tasks.Task{ID: "app.1", AppID: "/app", Host: "localhost", Ports: []int{8080}}
+		id, err := expandServiceIdTemplate(config.ServiceIdTemplate, sample, config)
+		if err != nil {
+			return fmt.Errorf("Invalid service ID template: %s", err)
+		}
+		if strings.TrimSpace(id) == "" {
+			return fmt.Errorf("Service ID template %s produces empty ID", config.ServiceIdTemplate)
+		}
+	}
+	if config.CheckInitialStatus != "" && !contains(CheckInitialStatuses, config.CheckInitialStatus) {
+		return fmt.Errorf("Unknown check initial status %s, expected one of %v", config.CheckInitialStatus, CheckInitialStatuses)
+	}
+	if config.AgentSelectionStrategy != "" && !contains(AgentSelectionStrategies, config.AgentSelectionStrategy) {
+		return fmt.Errorf("Unknown agent selection strategy %s, expected one of %v", config.AgentSelectionStrategy, AgentSelectionStrategies)
+	}
+	if config.EmptyDatacenterBehavior != "" && !contains(EmptyDatacenterBehaviors, config.EmptyDatacenterBehavior) {
+		return fmt.Errorf("Unknown empty datacenter behavior %s, expected one of %v", config.EmptyDatacenterBehavior, EmptyDatacenterBehaviors)
+	}
+	if config.DeregisterCriticalAfterObservations > 0 && config.CriticalWatchInterval <= 0 {
+		return fmt.Errorf("Critical watch interval must be positive")
+	}
+	if config.MaxIdleConnsPerHost < 0 || config.IdleConnTimeout < 0 {
+		return fmt.Errorf("Agent connection pooling settings must not be negative")
+	}
+	if config.ShortLivedCheckInterval < 0 {
+		return fmt.Errorf("Short-lived check interval must not be negative")
+	}
+	// Consul reaps critical services with one minute granularity
+	if config.ShortLivedDeregisterAfter != 0 && config.ShortLivedDeregisterAfter < time.Minute {
+		return fmt.Errorf("Short-lived deregister after must be at least 1m")
+	}
+	if config.DeregisterCriticalServiceAfter != 0 && config.DeregisterCriticalServiceAfter < time.Minute {
+		return fmt.Errorf("Deregister critical service after must be at least 1m")
+	}
+	if config.DatacentersCacheTTL < 0 {
+		return fmt.Errorf("Datacenters cache TTL must not be negative")
+	}
+	if config.ReadRetries < 0 || config.ReadRetryBackoff < 0 || config.ReadRetryMaxBackoff < 0 {
+		return fmt.Errorf("Read retries and backoff must not be negative")
+	}
+	if config.ReadRetries > 0 && config.ReadRetryBackoffMultiplier < 1 {
+		return fmt.Errorf("Read retry backoff multiplier must be at least 1")
+	}
+	if config.RateLimitRetries < 0 || config.RateLimitBackoff < 0 {
+		return fmt.Errorf("Rate limit retries and backoff must not be negative")
+	}
+	if config.MaxServicesPerAgent < 0 {
+		return fmt.Errorf("Max services per agent must not be negative")
+	}
+	if config.CatalogFetchConcurrency < 0 {
+		return fmt.Errorf("Catalog fetch concurrency must not be negative")
+	}
+	if config.ServiceNameSegments < 0 {
+		return fmt.Errorf("Service name segments must not be negative")
+	}
+	if config.CheckFailuresBeforeWarning < 0 {
+		return fmt.Errorf("Check failures before warning must not be negative")
+	}
+	if config.WeightDecaySteps > 0 && config.CriticalWatchInterval <= 0 {
+		return fmt.Errorf("Critical watch interval must be positive")
+	}
+	if config.WeightDecaySteps < 0 {
+		return fmt.Errorf("Weight decay steps must not be negative")
+	}
+	if config.DeregisterWeightRampSteps < 0 {
+		return fmt.Errorf("Deregister weight ramp steps must not be negative")
+	}
+	return nil
+}
@@ -1,24 +1,101 @@
 package consul
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
 	log "github.com/Sirupsen/logrus"
+	"github.com/allegro/marathon-consul/apps"
 	"github.com/allegro/marathon-consul/metrics"
+	"github.com/allegro/marathon-consul/tasks"
+	"github.com/allegro/marathon-consul/utils"
 	consulapi "github.com/hashicorp/consul/api"
 )
 
+var ErrNoDatacenters = errors.New("Consul returned no datacenters")
+
+var ErrAgentFull = errors.New("Agent reached services limit")
+
+// Outcome of task registration
+type RegisterOutcome int
+
+const (
+	RegistrationFailed RegisterOutcome = iota
+	// Service was written to Consul
+	Registered
+	// Service was already registered with the same content and was not written again
+	RegistrationUnchanged
+)
+
+// Outcome of service deregistration
+type DeregisterOutcome int
+
+const (
+	DeregistrationFailed DeregisterOutcome = iota
+	// Service was removed from Consul
+	Deregistered
+	// Service weight is being lowered, it is removed in background when ramp finishes
+	DeregistrationPending
+)
+
 type ConsulServices interface {
 	GetAllServices() ([]*consulapi.CatalogService, error)
 	Register(service *consulapi.AgentServiceRegistration) error
-	Deregister(serviceId string, agent string) error
+	RegisterTask(task tasks.Task, app *apps.App) (RegisterOutcome, error)
+	IsManaged(app *apps.App) bool
+	ServiceId(task tasks.Task) string
+	TaskServiceId(task tasks.Task) string
+	UpdateTaskHealth(taskId string, healthy bool) error
+	PruneRegistrations(liveServiceIds []string)
+	Deregister(serviceId string, agent string) (DeregisterOutcome, error)
 }
 
 type Consul struct {
-	agents Agents
+	agents        Agents
+	config        *ConsulConfig
+	registrations *registrations
+	publisher     Publisher
+	appMetrics    *appMetrics
+	agentNodes    map[string]agentNode
+	nameOwners    map[string]string
+	// Last datacenters list fetched from Consul
+	datacentersCache    []string
+	datacentersCachedAt time.Time
+	// Maintenance state set for services whose app needs minimum healthy instances
+	quorumMaintenance map[string]bool
+	// URLs of standalone checks registered for services
+	standaloneChecks map[string]string
+	// Service IDs of registered tasks by task ID
+	taskServices map[string]string
+	// Services having weight lowered before deregistration
+	rampingDown map[string]bool
+	rampDowns   sync.WaitGroup
+	// Closed when ramps are cut short on shutdown
+	rampStop     chan struct{}
+	rampsStopped bool
+	// Ticks between ramp steps, replaced in tests
+	rampTick func(time.Duration) <-chan time.Time
+	lock     sync.Mutex
 }
 
 func New(config ConsulConfig) *Consul {
 	return &Consul{
-		agents: NewAgents(&config),
+		agents:            NewAgents(&config),
+		config:            &config,
+		registrations:     newRegistrations(),
+		publisher:         newPublisher(config),
+		appMetrics:        newAppMetrics(config.MetricsAppLabel),
+		agentNodes:        make(map[string]agentNode),
+		nameOwners:        make(map[string]string),
+		quorumMaintenance: make(map[string]bool),
+		standaloneChecks:  make(map[string]string),
+		taskServices:      make(map[string]string),
+		rampingDown:       make(map[string]bool),
+		rampStop:          make(chan struct{}),
+		rampTick:          time.After,
 	}
 }
 
@@ -28,31 +105,361 @@ func (c *Consul) GetAllServices() ([]*consulapi.CatalogService, error) {
 	if err != nil {
 		return nil, err
 	}
-	datacenters, err := agent.Catalog().Datacenters()
+	datacenters, err := c.datacenters(agent)
 	if err != nil {
 		return nil, err
 	}
 	var allInstances []*consulapi.CatalogService
+	var failedDatacenters []string
+	seen := make(map[string]struct{})
 
 	for _, dc := range datacenters {
-		dcAwareQuery := &consulapi.QueryOptions{
-			Datacenter: dc,
+		instances, err := c.getServicesInDatacenter(agent, dc)
+		if err != nil {
+			if !c.config.BestEffortDCQueries {
+				return nil, err
+			}
+			metrics.Mark("consul.services.datacenter_error")
+			log.WithError(err).WithField("Datacenter", dc).Warn("Unable to get services from datacenter, skipping")
+			failedDatacenters = append(failedDatacenters, dc)
+			continue
+		}
+		allInstances = appendUniqueServices(allInstances, seen, dc, instances)
+	}
+	if len(datacenters) > 0 && len(failedDatacenters) == len(datacenters) {
+		return nil, fmt.Errorf("Unable to get services from any datacenter: %v", failedDatacenters)
+	}
+	c.checkManagedServicesThreshold(len(allInstances))
+	// Services of failed datacenters are unknown, not missing
+	if len(failedDatacenters) == 0 {
+		c.invalidateMissingRegistrations(allInstances)
+	}
+	return allInstances, nil
+}
+
+func (c *Consul) invalidateMissingRegistrations(services []*consulapi.CatalogService) {
+	if missing := c.registrations.invalidateMissing(services); missing > 0 {
+		metrics.Mark("consul.registrations.missing")
+		log.WithField("Count", missing).Info("Registered services missing from catalog, they will be registered again")
+	}
+}
+
+// Warns about suspiciously many managed services, e.g. caused by registration loop
+func (c *Consul) checkManagedServicesThreshold(count int) {
+	if c.config.MaxManagedServices <= 0 || count <= c.config.MaxManagedServices {
+		return
+	}
+	metrics.Mark("consul.catalog.over_threshold")
+	log.WithFields(log.Fields{
+		"Count":     count,
+		"Threshold": c.config.MaxManagedServices,
+	}).Warn("Number of managed services exceeds threshold")
+}
+
+// Lists datacenters to query, empty list is handled according to EmptyDatacenterBehavior
+func (c *Consul) datacenters(agent *consulapi.Client) ([]string, error) {
+	if datacenters, ok := c.cachedDatacenters(); ok {
+		return datacenters, nil
+	}
+	var datacenters []string
+	err := c.withReadRetries("datacenters", func() (err error) {
+		datacenters, err = agent.Catalog().Datacenters()
+		return err
+	})
+	if err != nil {
+		if lastKnown, ok := c.lastKnownDatacenters(); ok {
+			metrics.Mark("consul.datacenters.stale")
+			log.WithError(err).WithField("Datacenters", lastKnown).Warn("Unable to refresh datacenters, using last known ones")
+			return lastKnown, nil
 		}
-		services, _, err := agent.Catalog().Services(dcAwareQuery)
+		return nil, err
+	}
+	datacenters, err = c.queriedDatacenters(c.filterDatacenters(datacenters))
+	if err == nil {
+		c.cacheDatacenters(datacenters)
+	}
+	return datacenters, err
+}
+
+// Datacenters cached less than DatacentersCacheTTL ago
+func (c *Consul) cachedDatacenters() ([]string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.config.DatacentersCacheTTL <= 0 || c.datacentersCache == nil {
+		return nil, false
+	}
+	return c.datacentersCache, time.Since(c.datacentersCachedAt) < c.config.DatacentersCacheTTL
+}
+
+func (c *Consul) lastKnownDatacenters() ([]string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.datacentersCache, c.config.DatacentersCacheTTL > 0 && c.datacentersCache != nil
+}
+
+func (c *Consul) cacheDatacenters(datacenters []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.datacentersCache = datacenters
+	c.datacentersCachedAt = time.Now()
+}
+
+// Keeps only allowed datacenters (all when allow-list is empty) that are not excluded
+func (c *Consul) filterDatacenters(datacenters []string) []string {
+	for _, allowed := range c.config.Datacenters {
+		if !contains(datacenters, allowed) {
+			log.WithField("Datacenter", allowed).Warn("Allowed datacenter does not exist, ignoring")
+		}
+	}
+	var filtered []string
+	for _, dc := range datacenters {
+		if len(c.config.Datacenters) > 0 && !contains(c.config.Datacenters, dc) {
+			continue
+		}
+		if contains(c.config.ExcludeDatacenters, dc) {
+			continue
+		}
+		filtered = append(filtered, dc)
+	}
+	return filtered
+}
+
+func (c *Consul) queriedDatacenters(datacenters []string) ([]string, error) {
+	if len(datacenters) > 0 {
+		return datacenters, nil
+	}
+	if c.config.EmptyDatacenterBehavior == EmptyDatacentersDefault {
+		log.Warn("Consul returned no datacenters, querying agent datacenter only")
+		return []string{""}, nil
+	}
+	return nil, ErrNoDatacenters
+}
+
+func (c *Consul) queryOptions(dc string) *consulapi.QueryOptions {
+	return &consulapi.QueryOptions{
+		Datacenter: dc,
+		Partition:  c.config.Partition,
+		Token:      c.config.Token,
+	}
+}
+
+func (c *Consul) getServicesInDatacenter(agent *consulapi.Client, dc string) ([]*consulapi.CatalogService, error) {
+	dcAwareQuery := c.queryOptions(dc)
+	services, err := c.catalogServices(agent, dcAwareQuery)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for service, tags := range services {
+		if contains(tags, "marathon") {
+			names = append(names, service)
+		}
+	}
+	return c.getServicesInstances(agent, names, dcAwareQuery)
+}
+
+// Appends instances not seen yet in given datacenter, the same instance is returned only once
+// when queries overlap (e.g. datacenter listed twice)
+func appendUniqueServices(all []*consulapi.CatalogService, seen map[string]struct{}, dc string, instances []*consulapi.CatalogService) []*consulapi.CatalogService {
+	for _, instance := range instances {
+		key := dc + "/" + instance.Node + "/" + instance.ServiceID
+		if _, ok := seen[key]; ok {
+			metrics.Mark("consul.services.duplicate")
+			continue
+		}
+		seen[key] = struct{}{}
+		all = append(all, instance)
+	}
+	return all
+}
+
+// Fetches instances of given services running at most CatalogFetchConcurrency requests at once.
+// Returns first error encountered.
+func (c *Consul) getServicesInstances(agent *consulapi.Client, names []string, query *consulapi.QueryOptions) ([]*consulapi.CatalogService, error) {
+	var (
+		instances []*consulapi.CatalogService
+		lock      sync.Mutex
+	)
+	err := c.fetchConcurrently(names, func(name string) error {
+		var serviceInstances []*consulapi.CatalogService
+		err := c.withReadRetries("service", func() (err error) {
+			serviceInstances, _, err = agent.Catalog().Service(name, "marathon", query)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		instances = append(instances, serviceInstances...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return instances, nil
+}
+
+// Fetches health entries of given services running at most CatalogFetchConcurrency requests at once.
+// Returns first error encountered.
+func (c *Consul) getServicesEntries(agent *consulapi.Client, names []string, query *consulapi.QueryOptions) ([]*consulapi.ServiceEntry, error) {
+	var (
+		entries []*consulapi.ServiceEntry
+		lock    sync.Mutex
+	)
+	err := c.fetchConcurrently(names, func(name string) error {
+		var serviceEntries []*consulapi.ServiceEntry
+		err := c.withReadRetries("health", func() (err error) {
+			serviceEntries, _, err = agent.Health().Service(name, "marathon", false, query)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		entries = append(entries, serviceEntries...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Calls fetch for every name running at most CatalogFetchConcurrency calls at once.
+// Returns first error encountered.
+func (c *Consul) fetchConcurrently(names []string, fetch func(name string) error) error {
+	concurrency := c.config.CatalogFetchConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var (
+		firstErr error
+		lock     sync.Mutex
+		wg       sync.WaitGroup
+	)
+	slots := make(chan struct{}, concurrency)
+	for _, name := range names {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(name string) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			if err := fetch(name); err != nil {
+				lock.Lock()
+				defer lock.Unlock()
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}(name)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// Returns aggregated health status of every marathon service instance keyed by service ID
+func (c *Consul) GetAllServicesHealth() (map[string]string, error) {
+	entries, err := c.getAllServiceEntries()
+	if err != nil {
+		return nil, err
+	}
+	health := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		health[entry.Service.ID] = entry.Checks.AggregatedStatus()
+	}
+	return health, nil
+}
+
+// Deregisters marathon services from all datacenters with given meta key set to value
+func (c *Consul) DeregisterByMeta(key, value string) error {
+	entries, err := c.getAllServiceEntries()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, entry := range entries {
+		if metaValue, ok := entry.Service.Meta[key]; !ok || metaValue != value {
+			continue
+		}
+		if _, err := c.Deregister(entry.Service.ID, c.serviceAgentAddress(entry)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", entry.Service.ID, err))
+		}
+	}
+	return utils.MergeErrorsOrNil(errs, "deregistering services")
+}
+
+// Deregisters marathon services of all tasks of given app from all datacenters
+func (c *Consul) DeregisterByApp(appId string) error {
+	var err error
+	metrics.Time("consul.deregister_by_app", func() { err = c.DeregisterByMeta(AppIdMetaKey, appId) })
+	return err
+}
+
+// Returns health entries of marathon services from all datacenters
+func (c *Consul) getAllServiceEntries() ([]*consulapi.ServiceEntry, error) {
+	agent, err := c.agents.GetAnyAgent()
+	if err != nil {
+		return nil, err
+	}
+	datacenters, err := c.datacenters(agent)
+	if err != nil {
+		return nil, err
+	}
+	var allEntries []*consulapi.ServiceEntry
+	for _, dc := range datacenters {
+		dcAwareQuery := c.queryOptions(dc)
+		services, err := c.catalogServices(agent, dcAwareQuery)
 		if err != nil {
 			return nil, err
 		}
+		var names []string
 		for service, tags := range services {
 			if contains(tags, "marathon") {
-				serviceInstances, _, err := agent.Catalog().Service(service, "marathon", dcAwareQuery)
-				if err != nil {
-					return nil, err
-				}
-				allInstances = append(allInstances, serviceInstances...)
+				names = append(names, service)
 			}
 		}
+		entries, err := c.getServicesEntries(agent, names, dcAwareQuery)
+		if err != nil {
+			return nil, err
+		}
+		allEntries = append(allEntries, entries...)
 	}
-	return allInstances, nil
+	return allEntries, nil
+}
+
+// Returns health entries of marathon service with given name from all datacenters
+func (c *Consul) getServiceEntries(name string) ([]*consulapi.ServiceEntry, error) {
+	agent, err := c.agents.GetAnyAgent()
+	if err != nil {
+		return nil, err
+	}
+	datacenters, err := c.datacenters(agent)
+	if err != nil {
+		return nil, err
+	}
+	var allEntries []*consulapi.ServiceEntry
+	for _, dc := range datacenters {
+		entries, err := c.getServicesEntries(agent, []string{name}, c.queryOptions(dc))
+		if err != nil {
+			return nil, err
+		}
+		allEntries = append(allEntries, entries...)
+	}
+	return allEntries, nil
+}
+
+// Returns tags of all services in catalog keyed by service name
+func (c *Consul) catalogServices(agent *consulapi.Client, query *consulapi.QueryOptions) (map[string][]string, error) {
+	var services map[string][]string
+	err := c.withReadRetries("services", func() (err error) {
+		services, _, err = agent.Catalog().Services(query)
+		return err
+	})
+	return services, err
 }
 
 func contains(slice []string, search string) bool {
@@ -64,17 +471,306 @@ func contains(slice []string, search string) bool {
 	return false
 }
 
+// Registers service in agent running at service address
 func (c *Consul) Register(service *consulapi.AgentServiceRegistration) error {
-	var err error
-	metrics.Time("consul.register", func() { err = c.register(service) })
+	_, err := c.registerAt(service.Address, service)
 	return err
 }
 
-func (c *Consul) register(service *consulapi.AgentServiceRegistration) error {
-	agent, err := c.agents.GetAgent(service.Address)
+// Registers task service in agent running on task host
+func (c *Consul) RegisterTask(task tasks.Task, app *apps.App) (RegisterOutcome, error) {
+	service, err := c.buildRegistration(task, app)
+	if err != nil {
+		c.appMetrics.markRegister(c.ServiceId(task), app, RegistrationFailed)
+		return RegistrationFailed, err
+	}
+	name, err := c.resolveNameCollision(service.Name, app.ID)
+	if err != nil {
+		c.appMetrics.markRegister(service.ID, app, RegistrationFailed)
+		return RegistrationFailed, err
+	}
+	service.Name = name
+	written, err := c.registerAt(taskAgentAddress(task, app.Labels, c.config), service)
+	if err == nil {
+		c.rememberTaskService(task.ID, service.ID)
+		// registration might be skipped as unchanged, marathon health must be refreshed anyway
+		err = c.updateServiceHealth(service.ID, true)
+	}
+	if err == nil {
+		err = c.registerStandaloneCheck(task, app, service)
+	}
+	if err == nil {
+		c.enforceMinHealthyInstances(app)
+	}
+	result := Registered
+	if err != nil {
+		result = RegistrationFailed
+	} else if !written {
+		result = RegistrationUnchanged
+	}
+	c.appMetrics.markRegister(service.ID, app, result)
+	return result, err
+}
+
+// Registrations that would be sent for task without registering them, for previews and tests.
+// Tags and checks added by agent (datacenter tags, node alias check) and name collision
+// handling are not applied as they depend on registration state.
+func (c *Consul) BuildRegistrations(task tasks.Task, app *apps.App) ([]*consulapi.AgentServiceRegistration, error) {
+	service, err := c.buildRegistration(task, app)
+	if err != nil {
+		return nil, err
+	}
+	return []*consulapi.AgentServiceRegistration{service}, nil
+}
+
+func (c *Consul) buildRegistration(task tasks.Task, app *apps.App) (*consulapi.AgentServiceRegistration, error) {
+	if len(task.Ports) == 0 && app.Labels[c.config.label("socketPath")] == "" {
+		return nil, fmt.Errorf("Task %s has no ports", task.ID)
+	}
+	// check probing endpoint with other method than intended would report wrong health
+	if method, ok := app.Labels[c.config.label("check.method")]; ok && !contains(httpMethods, strings.ToUpper(method)) {
+		metrics.Mark("consul.register.invalid_check_method")
+		return nil, fmt.Errorf("Task %s has invalid health check method %s", task.ID, method)
+	}
+	service := appTaskToConsulService(task, app, c.config)
+	service.Tags = append(service.Tags, constraintTags(app.Constraints, c.config)...)
+	return service, nil
+}
+
+// Effective configuration with secrets redacted
+func (c *Consul) ConfigSnapshot() ConsulConfig {
+	return c.config.Redacted()
+}
+
+// Service ID of task built with configured template
+func (c *Consul) ServiceId(task tasks.Task) string {
+	return serviceId(task, c.config)
+}
+
+// ID of service registered for task, found by task ID meta in registrations and then in agent
+// on task host, so it matches services registered before restart or by another instance.
+// ID built from template is returned when service is not found.
+func (c *Consul) TaskServiceId(task tasks.Task) string {
+	if serviceId, ok := c.registrations.byTask(task.ID); ok {
+		return serviceId
+	}
+	if serviceId, ok := c.agentTaskService(task); ok {
+		return serviceId
+	}
+	return c.ServiceId(task)
+}
+
+func (c *Consul) agentTaskService(task tasks.Task) (string, bool) {
+	agent, err := c.agents.GetAgent(task.Host)
+	if err != nil {
+		return "", false
+	}
+	services, err := agent.Agent().Services()
+	if err != nil {
+		log.WithError(err).WithField("Id", task.ID).Warn("Unable to get agent services")
+		return "", false
+	}
+	for serviceId, service := range services {
+		if service.Meta[TaskIdMetaKey] == task.ID {
+			return serviceId, true
+		}
+	}
+	return "", false
+}
+
+// Events and health updates often carry only task ID, service IDs of registered
+// tasks are remembered so they do not have to be derived from it
+func (c *Consul) rememberTaskService(taskId string, serviceId string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.taskServices[taskId] = serviceId
+}
+
+func (c *Consul) rememberedTaskService(taskId string) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	serviceId, ok := c.taskServices[taskId]
+	return serviceId, ok
+}
+
+func (c *Consul) taskServiceId(taskId string) string {
+	if serviceId, ok := c.rememberedTaskService(taskId); ok {
+		return serviceId
+	}
+	return ServiceId(taskId)
+}
+
+func (c *Consul) forgetTaskService(serviceId string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for taskId, id := range c.taskServices {
+		if id == serviceId {
+			delete(c.taskServices, taskId)
+		}
+	}
+}
+
+// Passes or fails check mirroring marathon health of task registered by this instance.
+// Does nothing when marathon health check is disabled.
+func (c *Consul) UpdateTaskHealth(taskId string, healthy bool) error {
+	return c.updateServiceHealth(c.taskServiceId(taskId), healthy)
+}
+
+func (c *Consul) updateServiceHealth(serviceId string, healthy bool) error {
+	if c.config.MarathonHealthCheckTTL <= 0 {
+		return nil
+	}
+	agentAddress, ok := c.registrations.agent(serviceId)
+	if !ok {
+		return fmt.Errorf("Service %s was not registered by this instance", serviceId)
+	}
+	agent, err := c.agents.GetAgent(agentAddress)
 	if err != nil {
 		return err
 	}
+	status := "fail"
+	if healthy {
+		status = "pass"
+	}
+	return agent.Agent().UpdateTTL(marathonHealthCheckId(serviceId), "Marathon health check", status)
+}
+
+// Service name belongs to the app already registered under it in catalog or, when there is none,
+// to the first app registering it. Other apps deriving the same name are handled according
+// to OnServiceNameCollision.
+func (c *Consul) resolveNameCollision(name string, appId string) (string, error) {
+	if c.config.OnServiceNameCollision == "" || c.config.OnServiceNameCollision == NameCollisionMerge {
+		return name, nil
+	}
+	owner := c.nameOwner(name, appId)
+	if owner == appId {
+		return name, nil
+	}
+	switch c.config.OnServiceNameCollision {
+	case NameCollisionSuffixAppId:
+		metrics.Mark("consul.register.name_collision")
+		return name + "-" + strings.Replace(appIdToServiceName(appId, 0), ".", "-", -1), nil
+	case NameCollisionError:
+		metrics.Mark("consul.register.name_collision")
+		return "", fmt.Errorf("Service name %s of app %s is already used by app %s", name, appId, owner)
+	}
+	return name, nil
+}
+
+func (c *Consul) nameOwner(name string, appId string) string {
+	c.lock.Lock()
+	owner, ok := c.nameOwners[name]
+	c.lock.Unlock()
+	if ok {
+		return owner
+	}
+	// catalog is asked without holding the lock, first claim wins
+	owner = c.catalogNameOwner(name, appId)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if claimed, ok := c.nameOwners[name]; ok {
+		return claimed
+	}
+	c.nameOwners[name] = owner
+	return owner
+}
+
+// App of services already registered under name in agent datacenter, so ownership
+// survives restarts, given app when there are none or catalog can not be asked
+func (c *Consul) catalogNameOwner(name string, appId string) string {
+	agent, err := c.agents.GetAnyAgent()
+	if err != nil {
+		return appId
+	}
+	var instances []*consulapi.CatalogService
+	err = c.withReadRetries("service", func() (err error) {
+		instances, _, err = agent.Catalog().Service(name, "marathon", c.queryOptions(""))
+		return err
+	})
+	if err != nil {
+		log.WithError(err).WithField("Name", name).Warn("Unable to get service name owner from catalog")
+		return appId
+	}
+	owner := appId
+	for _, instance := range instances {
+		instanceAppId := instance.ServiceMeta[AppIdMetaKey]
+		if instanceAppId == appId {
+			return appId
+		}
+		if instanceAppId != "" && owner == appId {
+			owner = instanceAppId
+		}
+	}
+	return owner
+}
+
+// Name is released when the last service of owning app registered by this instance is deregistered
+func (c *Consul) releaseName(service *consulapi.AgentServiceRegistration) {
+	appId := service.Meta[AppIdMetaKey]
+	if appId == "" || c.registrations.hasApp(appId) {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for name, owner := range c.nameOwners {
+		if owner == appId {
+			delete(c.nameOwners, name)
+		}
+	}
+}
+
+// Returns whether service was written, unchanged services are not
+func (c *Consul) registerAt(agentAddress string, service *consulapi.AgentServiceRegistration) (bool, error) {
+	var (
+		written bool
+		err     error
+	)
+	metrics.Time("consul.register", func() { written, err = c.register(agentAddress, service) })
+	return written, err
+}
+
+func (c *Consul) IsManaged(app *apps.App) bool {
+	return isManagedApp(app.Labels, c.config)
+}
+
+func (c *Consul) register(agentAddress string, service *consulapi.AgentServiceRegistration) (bool, error) {
+	service = c.withDatacenterTags(agentAddress, service)
+	service = c.withNodeAliasCheck(agentAddress, service)
+	return c.registerPrepared(agentAddress, service)
+}
+
+// Registers service already extended with datacenter tags and node alias check,
+// e.g. stored registration
+func (c *Consul) registerPrepared(agentAddress string, service *consulapi.AgentServiceRegistration) (bool, error) {
+	if c.registrations.unchanged(service, agentAddress) {
+		metrics.Mark("consul.register.unchanged")
+		log.WithField("Id", service.ID).Debug("Registration unchanged, skipping")
+		return false, nil
+	}
+
+	if c.agentFull(service.ID, agentAddress) {
+		metrics.Mark("consul.register.agent_full")
+		log.WithFields(log.Fields{
+			"Id": service.ID, "Agent": agentAddress, "Limit": c.config.MaxServicesPerAgent,
+		}).Warn("Agent reached services limit, not registering")
+		return false, ErrAgentFull
+	}
+
+	agent, err := c.agents.GetAgent(agentAddress)
+	if err != nil {
+		return false, err
+	}
+
+	// Node is verified first so service is not left registered nowhere
+	if c.config.VerifyNodeBeforeRegister {
+		if err := verifyAgentNode(agent); err != nil {
+			metrics.Mark("consul.register.node_unhealthy")
+			log.WithError(err).WithField("Id", service.ID).Warn("Agent node is not healthy, not registering")
+			return false, err
+		}
+	}
+
+	c.deregisterFromPreviousAgent(service.ID, agentAddress)
 
 	log.WithFields(log.Fields{
 		"Name": service.Name,
@@ -84,7 +780,9 @@ func (c *Consul) register(service *consulapi.AgentServiceRegistration) error {
 		"Port": service.Port,
 	}).Info("Registering")
 
-	err = agent.Agent().ServiceRegister(service)
+	err = c.withRateLimitRetries("register", func() error {
+		return agent.Agent().ServiceRegister(service)
+	})
 	if err != nil {
 		log.WithError(err).WithFields(log.Fields{
 			"Name": service.Name,
@@ -93,17 +791,227 @@ func (c *Consul) register(service *consulapi.AgentServiceRegistration) error {
 			"Host": service.Address,
 			"Port": service.Port,
 		}).Warnf("Unable to register")
+	} else {
+		c.registrations.put(service, agentAddress)
+		c.publish(ServiceEvent{
+			Type:      ServiceRegistered,
+			ServiceID: service.ID,
+			Name:      service.Name,
+			Address:   service.Address,
+			Port:      service.Port,
+			Tags:      service.Tags,
+		})
 	}
-	return err
+	return err == nil, err
+}
+
+// Fails when agent node is missing from catalog or any of its node checks is critical
+func verifyAgentNode(agent *consulapi.Client) error {
+	node, err := agent.Agent().NodeName()
+	if err != nil {
+		return err
+	}
+	checks, _, err := agent.Health().Node(node, nil)
+	if err != nil {
+		return err
+	}
+	if len(checks) == 0 {
+		return fmt.Errorf("Node %s not found in catalog", node)
+	}
+	for _, check := range checks {
+		if check.ServiceID == "" && check.Status == consulapi.HealthCritical {
+			return fmt.Errorf("Node %s check %s is critical", node, check.CheckID)
+		}
+	}
+	return nil
 }
 
-func (c *Consul) Deregister(serviceId string, agent string) error {
+// Returns copy of service with tags configured for datacenter of agent it is registered in
+func (c *Consul) withDatacenterTags(agentAddress string, service *consulapi.AgentServiceRegistration) *consulapi.AgentServiceRegistration {
+	if len(c.config.TagsPerDatacenter) == 0 {
+		return service
+	}
+	node, err := c.agentNode(agentAddress)
+	if err != nil {
+		log.WithError(err).WithField("Address", agentAddress).Warn("Unable to get agent datacenter, skipping datacenter tags")
+		return service
+	}
+	tags, ok := c.config.TagsPerDatacenter[node.datacenter]
+	if !ok {
+		return service
+	}
+	withTags := *service
+	withTags.Tags = append(append([]string{}, service.Tags...), tags...)
+	return &withTags
+}
+
+// Returns copy of service with its check accompanied by alias of agent node health,
+// so node failure marks service critical without waiting for service check
+func (c *Consul) withNodeAliasCheck(agentAddress string, service *consulapi.AgentServiceRegistration) *consulapi.AgentServiceRegistration {
+	if !c.config.NodeAliasCheck {
+		return service
+	}
+	node, err := c.agentNode(agentAddress)
+	if err != nil {
+		log.WithError(err).WithField("Address", agentAddress).Warn("Unable to get agent node, skipping node alias check")
+		return service
+	}
+	withAlias := *service
+	withAlias.Checks = append(consulapi.AgentServiceChecks{}, service.Checks...)
+	if service.Check != nil {
+		withAlias.Checks = append(withAlias.Checks, service.Check)
+		withAlias.Check = nil
+	}
+	withAlias.Checks = append(withAlias.Checks, &consulapi.AgentServiceCheck{
+		Name:      "Node health",
+		AliasNode: node.name,
+	})
+	return &withAlias
+}
+
+type agentNode struct {
+	name       string
+	datacenter string
+}
+
+// Lock guards only the cache, agent is asked without holding it
+func (c *Consul) agentNode(address string) (agentNode, error) {
+	c.lock.Lock()
+	node, ok := c.agentNodes[address]
+	c.lock.Unlock()
+	if ok {
+		return node, nil
+	}
+	agent, err := c.agents.GetAgent(address)
+	if err != nil {
+		return agentNode{}, err
+	}
+	self, err := agent.Agent().Self()
+	if err != nil {
+		return agentNode{}, err
+	}
+	name, _ := self["Config"]["NodeName"].(string)
+	dc, _ := self["Config"]["Datacenter"].(string)
+	if name == "" || dc == "" {
+		return agentNode{}, fmt.Errorf("No node name or datacenter in agent config")
+	}
+	node = agentNode{name: name, datacenter: dc}
+	c.lock.Lock()
+	c.agentNodes[address] = node
+	c.lock.Unlock()
+	return node, nil
+}
+
+func (c *Consul) Deregister(serviceId string, agent string) (DeregisterOutcome, error) {
+	if c.startWeightRampDown(serviceId, agent) {
+		return DeregistrationPending, nil
+	}
+	if err := c.deregisterNow(serviceId, agent); err != nil {
+		return DeregistrationFailed, err
+	}
+	return Deregistered, nil
+}
+
+func (c *Consul) deregisterNow(serviceId string, agent string) error {
 	var err error
 	metrics.Time("consul.deregister", func() { err = c.deregister(serviceId, agent) })
+	c.appMetrics.markDeregister(serviceId, err)
 	return err
 }
 
+// Services with weights are ramped down and deregistered in background so event handling
+// and sync are not blocked. Returns false when service is deregistered right away.
+func (c *Consul) startWeightRampDown(serviceId string, agentAddress string) bool {
+	if c.config.DeregisterWeightRampSteps <= 0 {
+		return false
+	}
+	service, ok := c.registrations.get(serviceId)
+	if !ok || service.Weights == nil {
+		return false
+	}
+	c.lock.Lock()
+	if c.rampsStopped {
+		c.lock.Unlock()
+		return false
+	}
+	ramping := c.rampingDown[serviceId]
+	c.rampingDown[serviceId] = true
+	if !ramping {
+		c.rampDowns.Add(1)
+	}
+	c.lock.Unlock()
+	if ramping {
+		return true
+	}
+	metrics.Mark("consul.deregister.pending")
+	go func() {
+		defer func() {
+			c.lock.Lock()
+			delete(c.rampingDown, serviceId)
+			c.lock.Unlock()
+			c.rampDowns.Done()
+		}()
+		registeredAgent, _ := c.registrations.agent(serviceId)
+		if agent, err := c.agents.GetAgent(registeredAgent); err != nil {
+			log.WithError(err).WithField("Id", serviceId).Warn("Unable to lower weight before deregistration")
+		} else {
+			c.rampDownWeight(serviceId, func(service *consulapi.AgentServiceRegistration) error {
+				return c.withRateLimitRetries("ramp_down", func() error {
+					return agent.Agent().ServiceRegister(service)
+				})
+			})
+		}
+		if err := c.deregisterNow(serviceId, agentAddress); err != nil {
+			metrics.Mark("consul.deregister.pending.error")
+			log.WithError(err).WithField("Id", serviceId).Error("Unable to deregister service after lowering its weight")
+		}
+	}()
+	return true
+}
+
+// Cuts ongoing weight ramps short and waits until their services are deregistered,
+// services deregistered afterwards are removed right away. Called on shutdown.
+func (c *Consul) FinishWeightRampDowns() {
+	c.lock.Lock()
+	if !c.rampsStopped {
+		c.rampsStopped = true
+		close(c.rampStop)
+	}
+	c.lock.Unlock()
+	c.rampDowns.Wait()
+}
+
 func (c *Consul) deregister(serviceId string, agentAddress string) error {
+	// prefer agent service was registered in, it may listen on port set in app labels
+	if registeredAgent, ok := c.registrations.agent(serviceId); ok {
+		agentAddress = registeredAgent
+	}
+	err := c.deregisterFromAgent(serviceId, agentAddress)
+	if err != nil && c.config.CatalogDeregisterFallback && !isRateLimited(err) {
+		log.WithError(err).WithField("Id", serviceId).Warn("Unable to deregister from agent, deregistering from catalog")
+		metrics.Mark("consul.deregister.catalog_fallback")
+		err = c.deregisterFromCatalog(serviceId)
+	}
+	if err != nil {
+		log.WithError(err).WithField("Id", serviceId).Info("Deregistering")
+	} else {
+		service, registered := c.registrations.get(serviceId)
+		c.registrations.remove(serviceId)
+		if registered {
+			c.releaseName(service)
+		}
+		c.forgetQuorumMaintenance(serviceId)
+		c.forgetTaskService(serviceId)
+		c.publish(ServiceEvent{
+			Type:      ServiceDeregistered,
+			ServiceID: serviceId,
+			Address:   agentAddress,
+		})
+	}
+	return err
+}
+
+func (c *Consul) deregisterFromAgent(serviceId string, agentAddress string) error {
 	agent, err := c.agents.GetAgent(agentAddress)
 	if err != nil {
 		return err
@@ -111,9 +1019,125 @@ func (c *Consul) deregister(serviceId string, agentAddress string) error {
 
 	log.WithField("Id", serviceId).Info("Deregistering")
 
-	err = agent.Agent().ServiceDeregister(serviceId)
+	c.deregisterStandaloneCheck(serviceId, agent)
+	return c.withRateLimitRetries("deregister", func() error {
+		return agent.Agent().ServiceDeregisterOpts(serviceId, &consulapi.QueryOptions{Partition: c.servicePartition(serviceId), Token: c.config.Token})
+	})
+}
+
+// New services are refused by agents holding MaxServicesPerAgent services registered by this instance,
+// services already registered there can still be updated
+func (c *Consul) agentFull(serviceId string, agentAddress string) bool {
+	if c.config.MaxServicesPerAgent <= 0 {
+		return false
+	}
+	if registered, ok := c.registrations.agent(serviceId); ok && registered == agentAddress {
+		return false
+	}
+	return c.registrations.countAt(agentAddress) >= c.config.MaxServicesPerAgent
+}
+
+// Task host might change while its ID stays the same, service registered
+// in agent of previous host would be orphaned if it was not removed
+func (c *Consul) deregisterFromPreviousAgent(serviceId string, agentAddress string) {
+	previous, ok := c.registrations.agent(serviceId)
+	if !ok || previous == agentAddress {
+		return
+	}
+	metrics.Mark("consul.register.host_changed")
+	log.WithFields(log.Fields{
+		"Id": serviceId, "Previous": previous, "Current": agentAddress,
+	}).Info("Service host changed, deregistering from previous agent")
+	if err := c.deregisterFromAgent(serviceId, previous); err != nil {
+		log.WithError(err).WithField("Id", serviceId).Warn("Unable to deregister service from previous agent")
+	}
+}
+
+// Removes service directly from catalog of every datacenter it is found in,
+// used when agent service was registered in can not be reached
+func (c *Consul) deregisterFromCatalog(serviceId string) error {
+	// only services of unknown name need scan of whole catalog
+	var entries []*consulapi.ServiceEntry
+	var err error
+	if service, ok := c.registrations.get(serviceId); ok {
+		entries, err = c.getServiceEntries(service.Name)
+	} else {
+		entries, err = c.getAllServiceEntries()
+	}
 	if err != nil {
-		log.WithError(err).WithField("Id", serviceId).Info("Deregistering")
+		return err
+	}
+	agent, err := c.agents.GetAnyAgent()
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, entry := range entries {
+		if entry.Service.ID != serviceId {
+			continue
+		}
+		found = true
+		_, err := agent.Catalog().Deregister(&consulapi.CatalogDeregistration{
+			Node:       entry.Node.Node,
+			Datacenter: entry.Node.Datacenter,
+			ServiceID:  serviceId,
+			Partition:  c.servicePartition(serviceId),
+		}, &consulapi.WriteOptions{Token: c.config.Token})
+		if err != nil {
+			return err
+		}
+	}
+	if !found {
+		return fmt.Errorf("Service %s not found in catalog", serviceId)
+	}
+	return nil
+}
+
+// Partition service was registered in, configured partition for services registered by others
+func (c *Consul) servicePartition(serviceId string) string {
+	if service, ok := c.registrations.get(serviceId); ok {
+		return service.Partition
+	}
+	return c.config.Partition
+}
+
+// Gradually lowers weight of a registered service so it takes less traffic before it is removed
+func (c *Consul) rampDownWeight(serviceId string, register func(*consulapi.AgentServiceRegistration) error) {
+	service, ok := c.registrations.get(serviceId)
+	if !ok || service.Weights == nil {
+		return
+	}
+	steps := c.config.DeregisterWeightRampSteps
+	interval := c.config.DeregisterWeightRampDuration / time.Duration(steps)
+	for step := 1; step <= steps; step++ {
+		weight := service.Weights.Passing * (steps + 1 - step) / (steps + 1)
+		if weight < 1 {
+			weight = 1
+		}
+		rampedService := *service
+		rampedService.Weights = &consulapi.AgentWeights{Passing: weight, Warning: weight}
+		log.WithFields(log.Fields{
+			"Id":     serviceId,
+			"Weight": weight,
+		}).Debug("Lowering weight before deregistration")
+		if err := register(&rampedService); err != nil {
+			log.WithError(err).WithField("Id", serviceId).Warn("Unable to lower weight before deregistration")
+			return
+		}
+		select {
+		case <-c.rampTick(interval):
+		case <-c.rampStop:
+			return
+		}
+	}
+}
+
+func (c *Consul) publish(event ServiceEvent) {
+	if err := c.publisher.Publish(event); err != nil {
+		metrics.Mark("consul.publish.error")
+		log.WithError(err).WithFields(log.Fields{
+			"Type": event.Type,
+			"Id":   event.ServiceID,
+		}).Warn("Unable to publish event")
 	}
-	return err
 }
@@ -1,6 +1,8 @@
 package consul
 
 import (
+	"github.com/allegro/marathon-consul/apps"
+	"github.com/allegro/marathon-consul/tasks"
 	consulapi "github.com/hashicorp/consul/api"
 )
 
@@ -34,7 +36,33 @@ func (c *ConsulStub) Register(service *consulapi.AgentServiceRegistration) error
 	return nil
 }
 
-func (c *ConsulStub) Deregister(serviceId string, agent string) error {
-	delete(c.services, serviceId)
+func (c *ConsulStub) RegisterTask(task tasks.Task, app *apps.App) (RegisterOutcome, error) {
+	if err := c.Register(MarathonTaskToConsulService(task, app.HealthChecks, app.Labels)); err != nil {
+		return RegistrationFailed, err
+	}
+	return Registered, nil
+}
+
+func (c *ConsulStub) IsManaged(app *apps.App) bool {
+	return isManagedApp(app.Labels, &ConsulConfig{})
+}
+
+func (c *ConsulStub) ServiceId(task tasks.Task) string {
+	return ServiceId(task.ID)
+}
+
+func (c *ConsulStub) TaskServiceId(task tasks.Task) string {
+	return c.ServiceId(task)
+}
+
+func (c *ConsulStub) UpdateTaskHealth(taskId string, healthy bool) error {
 	return nil
 }
+
+func (c *ConsulStub) PruneRegistrations(liveServiceIds []string) {
+}
+
+func (c *ConsulStub) Deregister(serviceId string, agent string) (DeregisterOutcome, error) {
+	delete(c.services, serviceId)
+	return Deregistered, nil
+}
@@ -1,9 +1,14 @@
 package consul
 
 import (
+	"fmt"
+	"github.com/allegro/marathon-consul/apps"
+	"github.com/allegro/marathon-consul/tasks"
 	consulapi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/testutil"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestGetAllServices(t *testing.T) {
@@ -75,3 +80,1519 @@ func TestRegisterServices(t *testing.T) {
 	assert.Equal(t, "serviceA", services[0].ServiceName)
 	assert.Equal(t, []string{"test", "marathon"}, services[0].ServiceTags)
 }
+
+func TestRegisterSkipsUnchangedServices(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	service := &consulapi.AgentServiceRegistration{
+		ID:      "serviceA.1",
+		Name:    "serviceA",
+		Address: server.Config.Bind,
+		Port:    8080,
+		Tags:    []string{"marathon"},
+	}
+	consul.Register(service)
+
+	// given
+	unchanged := meterCount("consul.register.unchanged")
+
+	// when
+	err := consul.Register(service)
+
+	// then
+	assert.NoError(t, err)
+	assert.True(t, meterCount("consul.register.unchanged") > unchanged)
+}
+
+func TestRegisterTaskReportsUnchangedOutcome(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	app := &apps.App{ID: "/app", Labels: map[string]string{"consul": "true"}}
+	task := tasks.Task{ID: "app.1", AppID: "/app", Host: server.Config.Bind, Ports: []int{8080}}
+
+	// when
+	first, err := consul.RegisterTask(task, app)
+
+	// then
+	assert.NoError(t, err)
+	assert.Equal(t, Registered, first)
+
+	// when
+	second, err := consul.RegisterTask(task, app)
+
+	// then
+	assert.NoError(t, err)
+	assert.Equal(t, RegistrationUnchanged, second)
+}
+
+func TestRegisterRestoresServicesMissingFromCatalog(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	service := &consulapi.AgentServiceRegistration{
+		ID:      "serviceA.1",
+		Name:    "serviceA",
+		Address: server.Config.Bind,
+		Port:    8080,
+		Tags:    []string{"marathon"},
+	}
+	consul.Register(service)
+
+	// given
+	// registration is removed behind marathon-consul's back and sync notices it
+	agent, _ := consul.agents.GetAgent(server.Config.Bind)
+	agent.Agent().ServiceDeregister(service.ID)
+	services, _ := consul.GetAllServices()
+	assert.Empty(t, services)
+
+	// when
+	err := consul.Register(service)
+
+	// then
+	assert.NoError(t, err)
+	services, _ = consul.GetAllServices()
+	assert.Len(t, services, 1)
+}
+
+func TestRegisterChangedServices(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	service := &consulapi.AgentServiceRegistration{
+		ID:      "serviceA.1",
+		Name:    "serviceA",
+		Address: server.Config.Bind,
+		Port:    8080,
+		Tags:    []string{"marathon"},
+	}
+	consul.Register(service)
+
+	// given
+	changed := *service
+	changed.Port = 8081
+
+	// when
+	err := consul.Register(&changed)
+
+	// then
+	assert.NoError(t, err)
+	services, _ := consul.GetAllServices()
+	assert.Equal(t, 1, len(services))
+	assert.Equal(t, 8081, services[0].ServicePort)
+}
+
+type publisherStub struct {
+	events []ServiceEvent
+}
+
+func (p *publisherStub) Publish(event ServiceEvent) error {
+	p.events = append(p.events, event)
+	return nil
+}
+
+func TestRegisterAndDeregisterPublishEvents(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	publisher := &publisherStub{}
+	consul.publisher = publisher
+
+	// given
+	service := &consulapi.AgentServiceRegistration{
+		ID:      "serviceA.1",
+		Name:    "serviceA",
+		Address: server.Config.Bind,
+		Port:    8080,
+		Tags:    []string{"marathon"},
+	}
+
+	// when
+	consul.Register(service)
+	consul.Deregister(service.ID, server.Config.Bind)
+
+	// then
+	assert.Equal(t, []ServiceEvent{
+		{
+			Type:      ServiceRegistered,
+			ServiceID: "serviceA.1",
+			Name:      "serviceA",
+			Address:   server.Config.Bind,
+			Port:      8080,
+			Tags:      []string{"marathon"},
+		},
+		{
+			Type:      ServiceDeregistered,
+			ServiceID: "serviceA.1",
+			Address:   server.Config.Bind,
+		},
+	}, publisher.events)
+}
+
+func TestRampDownWeightBeforeDeregistration(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := consulClientAtAddress(server.Config.Bind, server.Config.Ports.HTTP)
+	consul.config.DeregisterWeightRampSteps = 3
+	consul.config.DeregisterWeightRampDuration = 3 * time.Millisecond
+
+	// given
+	app := &apps.App{
+		ID:           "serviceA",
+		HealthChecks: []apps.HealthCheck{},
+	}
+	task := tasks.Task{
+		ID:    "serviceA.1",
+		AppID: "serviceA",
+		Host:  server.Config.Bind,
+		Ports: []int{8080},
+	}
+	consul.RegisterTask(task, app)
+	var weights []int
+	recordWeight := func(service *consulapi.AgentServiceRegistration) error {
+		weights = append(weights, service.Weights.Passing)
+		return nil
+	}
+
+	// when
+	consul.rampDownWeight("serviceA.1", recordWeight)
+
+	// then
+	assert.Equal(t, []int{3, 2, 1}, weights)
+}
+
+func TestDeregisterRampsDownWeightInBackground(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := consulClientAtAddress(server.Config.Bind, server.Config.Ports.HTTP)
+	consul.config.DeregisterWeightRampSteps = 2
+	consul.config.DeregisterWeightRampDuration = time.Hour
+	ticks := make(chan time.Time)
+	waiting := make(chan time.Duration)
+	consul.rampTick = func(interval time.Duration) <-chan time.Time {
+		waiting <- interval
+		return ticks
+	}
+
+	// given
+	app := &apps.App{ID: "serviceA"}
+	task := tasks.Task{ID: "serviceA.1", AppID: "serviceA", Host: server.Config.Bind, Ports: []int{8080}}
+	assert.NoError(t, outcomeErr(consul.RegisterTask(task, app)))
+	agent, _ := consul.agents.GetAgent(server.Config.Bind)
+
+	// when
+	outcome, err := consul.Deregister("serviceA.1", server.Config.Bind)
+
+	// then caller is not blocked while service is lowered
+	assert.NoError(t, err)
+	assert.Equal(t, DeregistrationPending, outcome)
+	assert.Equal(t, 30*time.Minute, <-waiting)
+	services, _ := agent.Agent().Services()
+	assert.Equal(t, 2, services["serviceA.1"].Weights.Passing)
+
+	// when
+	ticks <- time.Now()
+
+	// then
+	<-waiting
+	services, _ = agent.Agent().Services()
+	assert.Equal(t, 1, services["serviceA.1"].Weights.Passing)
+
+	// when
+	ticks <- time.Now()
+	consul.rampDowns.Wait()
+
+	// then service is removed after ramp
+	services, _ = agent.Agent().Services()
+	assert.Empty(t, services)
+}
+
+func TestFinishWeightRampDownsDeregistersRampedServices(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := consulClientAtAddress(server.Config.Bind, server.Config.Ports.HTTP)
+	consul.config.DeregisterWeightRampSteps = 2
+	consul.config.DeregisterWeightRampDuration = time.Hour
+	waiting := make(chan time.Duration, 2)
+	consul.rampTick = func(interval time.Duration) <-chan time.Time {
+		waiting <- interval
+		return nil
+	}
+
+	// given
+	app := &apps.App{ID: "serviceA"}
+	task := tasks.Task{ID: "serviceA.1", AppID: "serviceA", Host: server.Config.Bind, Ports: []int{8080}}
+	assert.NoError(t, outcomeErr(consul.RegisterTask(task, app)))
+	agent, _ := consul.agents.GetAgent(server.Config.Bind)
+	consul.Deregister("serviceA.1", server.Config.Bind)
+	<-waiting
+
+	// when
+	consul.FinishWeightRampDowns()
+
+	// then
+	services, _ := agent.Agent().Services()
+	assert.Empty(t, services)
+
+	// when service is deregistered after shutdown started
+	assert.NoError(t, outcomeErr(consul.RegisterTask(task, app)))
+	outcome, err := consul.Deregister("serviceA.1", server.Config.Bind)
+
+	// then
+	assert.NoError(t, err)
+	assert.Equal(t, Deregistered, outcome)
+}
+
+func TestNoWeightsWithoutDeregisterWeightRamp(t *testing.T) {
+	t.Parallel()
+	// given
+	task := tasks.Task{
+		ID:    "serviceA.1",
+		AppID: "serviceA",
+		Ports: []int{8080},
+	}
+
+	// when
+	service := MarathonTaskToConsulService(task, nil, nil)
+
+	// then
+	assert.Nil(t, service.Weights)
+}
+
+func TestGetAllServicesFailsWhenDatacenterFails(t *testing.T) {
+	t.Parallel()
+	server1 := CreateConsulTestServer("dc1", t)
+	defer server1.Stop()
+	server2 := CreateConsulTestServer("dc2", t)
+	server1.JoinWAN(server2.LANAddr)
+
+	consul := ConsulClientAtServer(server1)
+
+	// given
+	server1.AddService("serviceA", "passing", []string{"marathon"})
+	server2.AddService("serviceB", "passing", []string{"marathon"})
+	server2.Stop()
+
+	// when
+	services, err := consul.GetAllServices()
+
+	// then
+	assert.Error(t, err)
+	assert.Nil(t, services)
+}
+
+func TestGetAllServicesWithBestEffortDCQueries(t *testing.T) {
+	t.Parallel()
+	server1 := CreateConsulTestServer("dc1", t)
+	defer server1.Stop()
+	server2 := CreateConsulTestServer("dc2", t)
+	server1.JoinWAN(server2.LANAddr)
+
+	consul := ConsulClientAtServer(server1)
+	consul.config.BestEffortDCQueries = true
+
+	// given
+	server1.AddService("serviceA", "passing", []string{"marathon"})
+	server2.AddService("serviceB", "passing", []string{"marathon"})
+	server2.Stop()
+
+	// when
+	services, err := consul.GetAllServices()
+
+	// then
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(services))
+	assert.Equal(t, "serviceA", services[0].ServiceName)
+}
+
+func TestGetAllServicesHealth(t *testing.T) {
+	t.Parallel()
+	server1 := CreateConsulTestServer("dc1", t)
+	defer server1.Stop()
+	server2 := CreateConsulTestServer("dc2", t)
+	defer server2.Stop()
+	server1.JoinWAN(server2.LANAddr)
+
+	consul := ConsulClientAtServer(server1)
+
+	// given
+	server1.AddService("serviceA", "passing", []string{"marathon"})
+	server1.AddService("serviceB", "critical", []string{"marathon"})
+	server1.AddService("serviceC", "passing", []string{"zookeeper"})
+	server2.AddService("serviceD", "warning", []string{"marathon"})
+
+	// when
+	health, err := consul.GetAllServicesHealth()
+
+	// then
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"serviceA": "passing",
+		"serviceB": "critical",
+		"serviceD": "warning",
+	}, health)
+}
+
+func TestGetAllServicesWithCatalogFetchConcurrency(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	consul.config.CatalogFetchConcurrency = 3
+
+	// given
+	for i := 0; i < 10; i++ {
+		server.AddService(fmt.Sprintf("service%d", i), "passing", []string{"marathon"})
+	}
+	server.AddService("other", "passing", []string{"zookeeper"})
+
+	// when
+	services, err := consul.GetAllServices()
+
+	// then
+	assert.NoError(t, err)
+	assert.Len(t, services, 10)
+}
+
+func TestGetServicesInstancesPropagatesErrors(t *testing.T) {
+	t.Parallel()
+	// create client pointing at address nothing listens at
+	consul := consulClientAtAddress("127.0.0.1", 1)
+	consul.config.CatalogFetchConcurrency = 2
+	agent, _ := consul.agents.GetAnyAgent()
+
+	// when
+	instances, err := consul.getServicesInstances(agent, []string{"serviceA", "serviceB", "serviceC"}, &consulapi.QueryOptions{})
+
+	// then
+	assert.Error(t, err)
+	assert.Nil(t, instances)
+}
+
+func TestGetAllServicesHealthWithCatalogFetchConcurrency(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	consul.config.CatalogFetchConcurrency = 3
+
+	// given
+	for i := 0; i < 10; i++ {
+		server.AddService(fmt.Sprintf("service%d", i), "passing", []string{"marathon"})
+	}
+	server.AddService("other", "passing", []string{"zookeeper"})
+
+	// when
+	health, err := consul.GetAllServicesHealth()
+
+	// then
+	assert.NoError(t, err)
+	assert.Len(t, health, 10)
+}
+
+func TestGetServicesEntriesPropagatesErrors(t *testing.T) {
+	t.Parallel()
+	// create client pointing at address nothing listens at
+	consul := consulClientAtAddress("127.0.0.1", 1)
+	consul.config.CatalogFetchConcurrency = 2
+	agent, _ := consul.agents.GetAnyAgent()
+
+	// when
+	entries, err := consul.getServicesEntries(agent, []string{"serviceA", "serviceB", "serviceC"}, &consulapi.QueryOptions{})
+
+	// then
+	assert.Error(t, err)
+	assert.Nil(t, entries)
+}
+
+func TestGetServiceEntriesFetchesOnlyGivenService(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+
+	// given
+	server.AddService("serviceA", "passing", []string{"marathon"})
+	server.AddService("serviceB", "passing", []string{"marathon"})
+
+	// when
+	entries, err := consul.getServiceEntries("serviceA")
+
+	// then
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "serviceA", entries[0].Service.Service)
+}
+
+func BenchmarkGetAllServices(b *testing.B) {
+	server := testutil.NewTestServerConfig(b, nil)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	consul.config.CatalogFetchConcurrency = 8
+	for i := 0; i < 100; i++ {
+		server.AddService(fmt.Sprintf("service%d", i), "passing", []string{"marathon"})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := consul.GetAllServices(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDeregisterByMeta(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+
+	// given
+	for id, team := range map[string]string{"serviceA": "deprecated", "serviceB": "core"} {
+		consul.Register(&consulapi.AgentServiceRegistration{
+			ID:      id,
+			Name:    id,
+			Address: "127.0.0.1",
+			Port:    8080,
+			Tags:    []string{"marathon"},
+			Meta:    map[string]string{"team": team},
+		})
+	}
+	consul.Register(&consulapi.AgentServiceRegistration{
+		ID:      "serviceC",
+		Name:    "serviceC",
+		Address: "127.0.0.1",
+		Port:    8080,
+		Tags:    []string{"marathon"},
+	})
+
+	// when
+	err := consul.DeregisterByMeta("team", "deprecated")
+
+	// then
+	assert.NoError(t, err)
+	services, _ := consul.GetAllServices()
+	assert.Len(t, services, 2)
+	for _, service := range services {
+		assert.NotEqual(t, "serviceA", service.ServiceID)
+	}
+}
+
+func TestDeregisterByApp(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	app := &apps.App{ID: "/app", Labels: map[string]string{"consul": "true"}}
+	other := &apps.App{ID: "/other", Labels: map[string]string{"consul": "true"}}
+
+	// given
+	consul.RegisterTask(tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.1", Ports: []int{8080}}, app)
+	consul.RegisterTask(tasks.Task{ID: "app.2", AppID: "/app", Host: "127.0.0.1", Ports: []int{8081}}, app)
+	consul.RegisterTask(tasks.Task{ID: "other.1", AppID: "/other", Host: "127.0.0.1", Ports: []int{8082}}, other)
+
+	// when
+	err := consul.DeregisterByApp("/app")
+
+	// then
+	assert.NoError(t, err)
+	services, _ := consul.GetAllServices()
+	assert.Len(t, services, 1)
+	assert.Equal(t, "other.1", services[0].ServiceMeta[TaskIdMetaKey])
+}
+
+func TestDeregisterByAppUsesNodeOfServicesWithPublicAddress(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	previous := ConsulClientAtServer(server)
+	app := &apps.App{ID: "/app", Labels: map[string]string{"consul": "true", "consul.publicAddress": "203.0.113.7"}}
+	assert.NoError(t, outcomeErr(previous.RegisterTask(tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.1", Ports: []int{8080}}, app)))
+
+	// given service registered by another instance
+	consul := ConsulClientAtServer(server)
+
+	// when
+	err := consul.DeregisterByApp("/app")
+
+	// then
+	assert.NoError(t, err)
+	services, _ := consul.GetAllServices()
+	assert.Empty(t, services)
+}
+
+func TestGetAllServicesMarksManagedServicesOverThreshold(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	consul.config.MaxManagedServices = 2
+
+	// given
+	server.AddService("serviceA", "passing", []string{"marathon"})
+	server.AddService("serviceB", "passing", []string{"marathon"})
+	overThreshold := meterCount("consul.catalog.over_threshold")
+
+	// when
+	consul.GetAllServices()
+
+	// then
+	assert.Equal(t, overThreshold, meterCount("consul.catalog.over_threshold"))
+
+	// given
+	server.AddService("serviceC", "passing", []string{"marathon"})
+
+	// when
+	consul.GetAllServices()
+
+	// then
+	assert.Equal(t, overThreshold+1, meterCount("consul.catalog.over_threshold"))
+}
+
+func TestRegisterAddsTagsPerDatacenter(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	consul.config.TagsPerDatacenter = map[string][]string{
+		"dc1": {"local"},
+		"dc2": {"remote"},
+	}
+
+	// given
+	service := &consulapi.AgentServiceRegistration{
+		ID:      "serviceA",
+		Name:    "serviceA",
+		Address: "127.0.0.1",
+		Port:    8080,
+		Tags:    []string{"marathon"},
+	}
+
+	// when
+	err := consul.Register(service)
+
+	// then
+	assert.NoError(t, err)
+	services, _ := consul.GetAllServices()
+	assert.Len(t, services, 1)
+	assert.Equal(t, []string{"marathon", "local"}, services[0].ServiceTags)
+	assert.Equal(t, []string{"marathon"}, service.Tags)
+
+	assert.True(t, consul.registrations.unchanged(consul.withDatacenterTags("127.0.0.1", service), "127.0.0.1"))
+}
+
+func TestFilterDatacenters(t *testing.T) {
+	t.Parallel()
+	// given
+	consul := consulClientAtAddress("127.0.0.1", 8500)
+	all := []string{"dc1", "dc2", "dc3"}
+
+	// then
+	assert.Equal(t, all, consul.filterDatacenters(all))
+
+	// when
+	consul.config.Datacenters = []string{"dc1", "dc3", "missing"}
+
+	// then
+	assert.Equal(t, []string{"dc1", "dc3"}, consul.filterDatacenters(all))
+
+	// when
+	consul.config.ExcludeDatacenters = []string{"dc3"}
+
+	// then
+	assert.Equal(t, []string{"dc1"}, consul.filterDatacenters(all))
+
+	// when
+	consul.config.Datacenters = nil
+
+	// then
+	assert.Equal(t, []string{"dc1", "dc2"}, consul.filterDatacenters(all))
+}
+
+func TestGetAllServicesFromAllowedDatacentersOnly(t *testing.T) {
+	t.Parallel()
+	server1 := CreateConsulTestServer("dc1", t)
+	defer server1.Stop()
+	server2 := CreateConsulTestServer("dc2", t)
+	defer server2.Stop()
+	server1.JoinWAN(server2.LANAddr)
+
+	consul := ConsulClientAtServer(server1)
+	consul.config.Datacenters = []string{"dc2"}
+
+	// given
+	server1.AddService("serviceA", "passing", []string{"marathon"})
+	server2.AddService("serviceB", "passing", []string{"marathon"})
+
+	// when
+	services, err := consul.GetAllServices()
+
+	// then
+	assert.NoError(t, err)
+	assert.Len(t, services, 1)
+	assert.Equal(t, "serviceB", services[0].ServiceName)
+}
+
+func TestQueriedDatacentersWhenConsulReturnsNone(t *testing.T) {
+	t.Parallel()
+	// given
+	consul := consulClientAtAddress("127.0.0.1", 8500)
+
+	// when
+	datacenters, err := consul.queriedDatacenters([]string{})
+
+	// then
+	assert.Equal(t, ErrNoDatacenters, err)
+	assert.Nil(t, datacenters)
+
+	// given
+	consul.config.EmptyDatacenterBehavior = EmptyDatacentersDefault
+
+	// when
+	datacenters, err = consul.queriedDatacenters([]string{})
+
+	// then
+	assert.NoError(t, err)
+	assert.Equal(t, []string{""}, datacenters)
+
+	// when
+	datacenters, err = consul.queriedDatacenters([]string{"dc1", "dc2"})
+
+	// then
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dc1", "dc2"}, datacenters)
+}
+
+func TestRegisterTaskInAgentOnPortFromLabel(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	// create client with default agent port nothing listens at
+	consul := consulClientAtAddress("127.0.0.1", 1)
+	agentPort := fmt.Sprintf("%d", server.Config.Ports.HTTP)
+
+	// given
+	app := &apps.App{
+		ID: "/app",
+		Labels: map[string]string{
+			"consul":           "true",
+			"consul.agentPort": agentPort,
+		},
+	}
+	task := tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.1", Ports: []int{8080}}
+
+	// when
+	_, err := consul.RegisterTask(task, app)
+
+	// then
+	assert.NoError(t, err)
+	agent, _ := consul.agents.GetAgent("127.0.0.1:" + agentPort)
+	services, _ := agent.Agent().Services()
+	assert.Contains(t, services, "app.1")
+
+	// when
+	_, err = consul.Deregister("app.1", "127.0.0.1")
+
+	// then
+	assert.NoError(t, err)
+	services, _ = agent.Agent().Services()
+	assert.Empty(t, services)
+}
+
+func TestRegisterDeregistersServiceFromPreviousHost(t *testing.T) {
+	t.Parallel()
+	oldHost := CreateConsulTestServer("dc1", t)
+	defer oldHost.Stop()
+	newHost := CreateConsulTestServer("dc1", t)
+	defer newHost.Stop()
+
+	consul := ConsulClientAtServer(oldHost)
+	oldAgentAddress := fmt.Sprintf("127.0.0.1:%d", oldHost.Config.Ports.HTTP)
+	newAgentAddress := fmt.Sprintf("127.0.0.1:%d", newHost.Config.Ports.HTTP)
+	service := func(address string) *consulapi.AgentServiceRegistration {
+		return &consulapi.AgentServiceRegistration{
+			ID:      "app.1",
+			Name:    "app",
+			Address: address,
+			Port:    8080,
+			Tags:    []string{"marathon"},
+		}
+	}
+
+	// given
+	assert.NoError(t, outcomeErr(consul.register(oldAgentAddress, service("10.0.0.1"))))
+
+	// when
+	_, err := consul.register(newAgentAddress, service("10.0.0.2"))
+
+	// then
+	assert.NoError(t, err)
+	oldAgent, _ := consul.agents.GetAgent(oldAgentAddress)
+	oldServices, _ := oldAgent.Agent().Services()
+	assert.Empty(t, oldServices)
+	newAgent, _ := consul.agents.GetAgent(newAgentAddress)
+	newServices, _ := newAgent.Agent().Services()
+	assert.Contains(t, newServices, "app.1")
+	agentAddress, _ := consul.registrations.agent("app.1")
+	assert.Equal(t, newAgentAddress, agentAddress)
+}
+
+func TestRegisterDeregistersUnchangedServiceFromPreviousHost(t *testing.T) {
+	t.Parallel()
+	oldHost := CreateConsulTestServer("dc1", t)
+	defer oldHost.Stop()
+	newHost := CreateConsulTestServer("dc1", t)
+	defer newHost.Stop()
+
+	consul := ConsulClientAtServer(oldHost)
+	oldAgentAddress := fmt.Sprintf("127.0.0.1:%d", oldHost.Config.Ports.HTTP)
+	newAgentAddress := fmt.Sprintf("127.0.0.1:%d", newHost.Config.Ports.HTTP)
+	// registered without address, e.g. with UseAgentAddress, so content does not change with host
+	service := &consulapi.AgentServiceRegistration{
+		ID:   "app.1",
+		Name: "app",
+		Port: 8080,
+		Tags: []string{"marathon"},
+	}
+
+	// given
+	assert.NoError(t, outcomeErr(consul.register(oldAgentAddress, service)))
+
+	// when
+	_, err := consul.register(newAgentAddress, service)
+
+	// then
+	assert.NoError(t, err)
+	oldAgent, _ := consul.agents.GetAgent(oldAgentAddress)
+	oldServices, _ := oldAgent.Agent().Services()
+	assert.Empty(t, oldServices)
+	newAgent, _ := consul.agents.GetAgent(newAgentAddress)
+	newServices, _ := newAgent.Agent().Services()
+	assert.Contains(t, newServices, "app.1")
+}
+
+func TestRegisterKeepsPreviousHostServiceWhenNewNodeIsUnhealthy(t *testing.T) {
+	t.Parallel()
+	oldHost := CreateConsulTestServer("dc1", t)
+	defer oldHost.Stop()
+	newHost := CreateConsulTestServer("dc1", t)
+	defer newHost.Stop()
+
+	consul := ConsulClientAtServer(oldHost)
+	consul.config.VerifyNodeBeforeRegister = true
+	oldAgentAddress := fmt.Sprintf("127.0.0.1:%d", oldHost.Config.Ports.HTTP)
+	newAgentAddress := fmt.Sprintf("127.0.0.1:%d", newHost.Config.Ports.HTTP)
+	service := &consulapi.AgentServiceRegistration{
+		ID:   "app.1",
+		Name: "app",
+		Port: 8080,
+		Tags: []string{"marathon"},
+	}
+	assert.NoError(t, outcomeErr(consul.register(oldAgentAddress, service)))
+
+	// given
+	newHost.AddCheck("node-maintenance", "", "critical")
+
+	// when
+	_, err := consul.register(newAgentAddress, service)
+
+	// then
+	assert.Error(t, err)
+	oldAgent, _ := consul.agents.GetAgent(oldAgentAddress)
+	oldServices, _ := oldAgent.Agent().Services()
+	assert.Contains(t, oldServices, "app.1")
+}
+
+func TestRegisterRefusesServicesPastAgentLimit(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	consul.config.MaxServicesPerAgent = 2
+	service := func(id string) *consulapi.AgentServiceRegistration {
+		return &consulapi.AgentServiceRegistration{
+			ID:      id,
+			Name:    "app",
+			Address: "127.0.0.1",
+			Port:    8080,
+			Tags:    []string{"marathon"},
+		}
+	}
+
+	// given
+	assert.NoError(t, consul.Register(service("app.1")))
+	assert.NoError(t, consul.Register(service("app.2")))
+	agentFull := meterCount("consul.register.agent_full")
+
+	// when
+	err := consul.Register(service("app.3"))
+
+	// then
+	assert.Equal(t, ErrAgentFull, err)
+	assert.Equal(t, agentFull+1, meterCount("consul.register.agent_full"))
+	agent, _ := consul.agents.GetAgent("127.0.0.1")
+	services, _ := agent.Agent().Services()
+	assert.Len(t, services, 2)
+
+	// when already registered service is updated
+	updated := service("app.2")
+	updated.Port = 8081
+	err = consul.Register(updated)
+
+	// then
+	assert.NoError(t, err)
+
+	// when
+	assert.NoError(t, outcomeErr(consul.Deregister("app.1", "127.0.0.1")))
+	err = consul.Register(service("app.3"))
+
+	// then
+	assert.NoError(t, err)
+}
+
+func TestRegisterTaskWithUseAgentAddress(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	consul.config.UseAgentAddress = true
+
+	// given
+	app := &apps.App{ID: "/app", Labels: map[string]string{"consul": "true"}}
+	task := tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.1", Ports: []int{8080}}
+
+	// when
+	_, err := consul.RegisterTask(task, app)
+
+	// then
+	assert.NoError(t, err)
+	services, _ := consul.GetAllServices()
+	assert.Len(t, services, 1)
+	assert.Empty(t, services[0].ServiceAddress)
+}
+
+func TestRegisterTaskWithTagsFromConstraints(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	consul.config.TagFromConstraints = []string{"rack_id"}
+
+	// given
+	app := &apps.App{
+		ID:          "/app",
+		Labels:      map[string]string{"consul": "true"},
+		Constraints: [][]string{{"rack_id", "CLUSTER", "rack-1"}, {"hostname", "UNIQUE"}},
+	}
+	task := tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.1", Ports: []int{8080}}
+
+	// when
+	_, err := consul.RegisterTask(task, app)
+
+	// then
+	assert.NoError(t, err)
+	services, _ := consul.GetAllServices()
+	assert.Len(t, services, 1)
+	assert.Equal(t, []string{"marathon", "rack_id:CLUSTER:rack-1"}, services[0].ServiceTags)
+}
+
+func TestRegisterVerifiesAgentNodeHealth(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	consul.config.VerifyNodeBeforeRegister = true
+	service := &consulapi.AgentServiceRegistration{
+		ID:      "serviceA",
+		Name:    "serviceA",
+		Address: "127.0.0.1",
+		Port:    8080,
+		Tags:    []string{"marathon"},
+	}
+
+	// when node is healthy
+	err := consul.Register(service)
+
+	// then
+	assert.NoError(t, err)
+	consul.Deregister("serviceA", "127.0.0.1")
+
+	// given
+	server.AddCheck("node-maintenance", "", "critical")
+
+	// when
+	err = consul.Register(service)
+
+	// then
+	assert.Error(t, err)
+	services, _ := consul.GetAllServices()
+	assert.Empty(t, services)
+}
+
+func TestAppendUniqueServicesSkipsDuplicates(t *testing.T) {
+	t.Parallel()
+	// given
+	seen := make(map[string]struct{})
+	instances := []*consulapi.CatalogService{
+		{Node: "node1", ServiceID: "serviceA"},
+		{Node: "node1", ServiceID: "serviceB"},
+	}
+
+	// when
+	all := appendUniqueServices(nil, seen, "dc1", instances)
+	all = appendUniqueServices(all, seen, "dc1", instances)
+	all = appendUniqueServices(all, seen, "dc2", instances[:1])
+
+	// then
+	assert.Len(t, all, 3)
+}
+
+func TestQueryOptionsUseConfiguredPartition(t *testing.T) {
+	t.Parallel()
+	// given
+	consul := consulClientAtAddress("127.0.0.1", 8500)
+	consul.config.Partition = "platform"
+
+	// when
+	query := consul.queryOptions("dc1")
+
+	// then
+	assert.Equal(t, "dc1", query.Datacenter)
+	assert.Equal(t, "platform", query.Partition)
+}
+
+func TestQueryOptionsUseConfiguredToken(t *testing.T) {
+	t.Parallel()
+	// given
+	consul := consulClientAtAddress("127.0.0.1", 8500)
+	consul.config.Token = "secret-token"
+
+	// when
+	query := consul.queryOptions("dc1")
+
+	// then
+	assert.Equal(t, "secret-token", query.Token)
+}
+
+func TestDeregisterFromPartitionServiceWasRegisteredIn(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	consul.config.Partition = "platform"
+
+	// given
+	app := &apps.App{ID: "/app", Labels: map[string]string{"consul": "true", "consul.partition": "payments"}}
+	task := tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.1", Ports: []int{8080}}
+	consul.RegisterTask(task, app)
+
+	// then
+	assert.Equal(t, "payments", consul.servicePartition("app.1"))
+	assert.Equal(t, "platform", consul.servicePartition("other"))
+
+	// when
+	_, err := consul.Deregister("app.1", "127.0.0.1")
+
+	// then
+	assert.NoError(t, err)
+}
+
+func TestRegisterWithNodeAliasCheck(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	consul.config.NodeAliasCheck = true
+
+	// given
+	service := &consulapi.AgentServiceRegistration{
+		ID:      "serviceA",
+		Name:    "serviceA",
+		Address: "127.0.0.1",
+		Port:    8080,
+		Tags:    []string{"marathon"},
+		Check: &consulapi.AgentServiceCheck{
+			TCP:      "127.0.0.1:8080",
+			Interval: "10s",
+		},
+	}
+
+	// when
+	err := consul.Register(service)
+
+	// then
+	assert.NoError(t, err)
+	registered, _ := consul.registrations.get("serviceA")
+	assert.Nil(t, registered.Check)
+	assert.Len(t, registered.Checks, 2)
+	assert.Equal(t, "127.0.0.1:8080", registered.Checks[0].TCP)
+	assert.Equal(t, server.Config.NodeName, registered.Checks[1].AliasNode)
+	assert.Equal(t, "127.0.0.1:8080", service.Check.TCP)
+}
+
+func TestDeregisterFallsBackToCatalogWhenAgentIsUnresolvable(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+
+	// given
+	server.AddService("serviceA", "passing", []string{"marathon"})
+
+	// when fallback is disabled
+	_, err := consul.Deregister("serviceA", "")
+
+	// then
+	assert.Error(t, err)
+	services, _ := consul.GetAllServices()
+	assert.Len(t, services, 1)
+
+	// when fallback is enabled
+	consul.config.CatalogDeregisterFallback = true
+	_, err = consul.Deregister("serviceA", "")
+
+	// then
+	assert.NoError(t, err)
+	services, _ = consul.GetAllServices()
+	assert.Empty(t, services)
+}
+
+func TestResolveNameCollision(t *testing.T) {
+	t.Parallel()
+	// given
+	merge := consulClientAtAddress("127.0.0.1", 8500)
+	suffix := consulClientAtAddress("127.0.0.1", 8500)
+	suffix.config.OnServiceNameCollision = NameCollisionSuffixAppId
+	fail := consulClientAtAddress("127.0.0.1", 8500)
+	fail.config.OnServiceNameCollision = NameCollisionError
+
+	for _, consul := range []*Consul{merge, suffix, fail} {
+		name, err := consul.resolveNameCollision("service", "/team/service")
+		assert.NoError(t, err)
+		assert.Equal(t, "service", name)
+		name, err = consul.resolveNameCollision("service", "/team/service")
+		assert.NoError(t, err)
+		assert.Equal(t, "service", name)
+	}
+
+	// when
+	merged, mergeErr := merge.resolveNameCollision("service", "/other/service")
+	suffixed, suffixErr := suffix.resolveNameCollision("service", "/other/service")
+	_, failErr := fail.resolveNameCollision("service", "/other/service")
+
+	// then
+	assert.NoError(t, mergeErr)
+	assert.Equal(t, "service", merged)
+	assert.NoError(t, suffixErr)
+	assert.Equal(t, "service-other-service", suffixed)
+	assert.Error(t, failErr)
+}
+
+func TestServiceNameIsReleasedWhenOwningAppIsDeregistered(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	consul.config.OnServiceNameCollision = NameCollisionError
+	consul.config.ServiceNameSegments = 1
+	owner := &apps.App{ID: "/team/service", Labels: map[string]string{"consul": "true"}}
+	replacement := &apps.App{ID: "/other/service", Labels: map[string]string{"consul": "true"}}
+	ownerTask := tasks.Task{ID: "team_service.1", AppID: "/team/service", Host: "127.0.0.1", Ports: []int{8080}}
+	replacementTask := tasks.Task{ID: "other_service.1", AppID: "/other/service", Host: "127.0.0.1", Ports: []int{8081}}
+	assert.NoError(t, outcomeErr(consul.RegisterTask(ownerTask, owner)))
+	assert.Error(t, outcomeErr(consul.RegisterTask(replacementTask, replacement)))
+
+	// given
+	assert.NoError(t, outcomeErr(consul.Deregister("team_service.1", "127.0.0.1")))
+
+	// when
+	_, err := consul.RegisterTask(replacementTask, replacement)
+
+	// then
+	assert.NoError(t, err)
+}
+
+func TestServiceNameOwnerIsTakenFromCatalog(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	owner := &apps.App{ID: "/team/service", Labels: map[string]string{"consul": "true"}}
+	other := &apps.App{ID: "/other/service", Labels: map[string]string{"consul": "true"}}
+	ownerTask := tasks.Task{ID: "team_service.1", AppID: "/team/service", Host: "127.0.0.1", Ports: []int{8080}}
+	otherTask := tasks.Task{ID: "other_service.1", AppID: "/other/service", Host: "127.0.0.1", Ports: []int{8081}}
+	previous := ConsulClientAtServer(server)
+	previous.config.ServiceNameSegments = 1
+	assert.NoError(t, outcomeErr(previous.RegisterTask(ownerTask, owner)))
+
+	// given
+	// instance restarted and other app registers first
+	consul := ConsulClientAtServer(server)
+	consul.config.OnServiceNameCollision = NameCollisionSuffixAppId
+	consul.config.ServiceNameSegments = 1
+
+	// when
+	_, err := consul.RegisterTask(otherTask, other)
+
+	// then
+	assert.NoError(t, err)
+	services, _ := consul.GetAllServices()
+	names := make(map[string]string)
+	for _, service := range services {
+		names[service.ServiceID] = service.ServiceName
+	}
+	assert.Equal(t, map[string]string{"team_service.1": "service", "other_service.1": "service-other-service"}, names)
+}
+
+func TestMarathonHealthCheckMirrorsTaskHealth(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	consul.config.MarathonHealthCheckTTL = time.Hour
+	agent, _ := consul.agents.GetAgent("127.0.0.1")
+	status := func() string {
+		checks, _ := agent.Agent().Checks()
+		return checks["marathon-health:app.1"].Status
+	}
+
+	// given
+	app := &apps.App{ID: "/app", Labels: map[string]string{"consul": "true"}}
+	task := tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.1", Ports: []int{8080}}
+
+	// when
+	_, err := consul.RegisterTask(task, app)
+
+	// then
+	assert.NoError(t, err)
+	assert.Equal(t, consulapi.HealthPassing, status())
+
+	// when
+	err = consul.UpdateTaskHealth(task.ID, false)
+
+	// then
+	assert.NoError(t, err)
+	assert.Equal(t, consulapi.HealthCritical, status())
+
+	// when registered again after task recovers
+	_, err = consul.RegisterTask(task, app)
+
+	// then
+	assert.NoError(t, err)
+	assert.Equal(t, consulapi.HealthPassing, status())
+}
+
+func TestUpdateTaskHealthOfUnknownTask(t *testing.T) {
+	t.Parallel()
+	// given
+	consul := consulClientAtAddress("127.0.0.1", 8500)
+
+	// then
+	assert.NoError(t, consul.UpdateTaskHealth("unknown", false))
+
+	// when
+	consul.config.MarathonHealthCheckTTL = time.Hour
+
+	// then
+	assert.Error(t, consul.UpdateTaskHealth("unknown", false))
+}
+
+func TestDatacentersAreCachedForTTL(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+
+	consul := ConsulClientAtServer(server)
+	consul.config.DatacentersCacheTTL = time.Hour
+	agent, _ := consul.agents.GetAgent("127.0.0.1")
+
+	// given
+	datacenters, err := consul.datacenters(agent)
+	assert.NoError(t, err)
+
+	// when
+	server.Stop()
+	cached, err := consul.datacenters(agent)
+
+	// then
+	assert.NoError(t, err)
+	assert.Equal(t, datacenters, cached)
+	assert.Equal(t, []string{"dc1"}, cached)
+}
+
+func TestDatacentersFallBackToLastKnownWhenRefreshFails(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+
+	consul := ConsulClientAtServer(server)
+	consul.config.DatacentersCacheTTL = time.Nanosecond
+	agent, _ := consul.agents.GetAgent("127.0.0.1")
+
+	// given
+	_, err := consul.datacenters(agent)
+	assert.NoError(t, err)
+
+	// when
+	server.Stop()
+	time.Sleep(time.Millisecond)
+	datacenters, err := consul.datacenters(agent)
+
+	// then
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dc1"}, datacenters)
+}
+
+func TestDatacentersFailWithoutCache(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+
+	consul := ConsulClientAtServer(server)
+	agent, _ := consul.agents.GetAgent("127.0.0.1")
+
+	// given
+	_, err := consul.datacenters(agent)
+	assert.NoError(t, err)
+
+	// when
+	server.Stop()
+	_, err = consul.datacenters(agent)
+
+	// then
+	assert.Error(t, err)
+}
+
+func TestRegisterTaskWithServiceIdTemplate(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	consul.config.ServiceIdTemplate = "{{.Name}}_{{.TaskID}}_{{.Port}}"
+	consul.config.MarathonHealthCheckTTL = time.Hour
+
+	// given
+	app := &apps.App{ID: "/app", Labels: map[string]string{"consul": "true"}}
+	task := tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.1", Ports: []int{8080}}
+
+	// when
+	_, err := consul.RegisterTask(task, app)
+
+	// then
+	assert.NoError(t, err)
+	assert.Equal(t, "app_app.1_8080", consul.ServiceId(task))
+	agent, _ := consul.agents.GetAgent("127.0.0.1")
+	services, _ := agent.Agent().Services()
+	assert.Contains(t, services, "app_app.1_8080")
+
+	// when health is updated knowing only task ID
+	err = consul.UpdateTaskHealth(task.ID, false)
+
+	// then
+	assert.NoError(t, err)
+	checks, _ := agent.Agent().Checks()
+	assert.Equal(t, consulapi.HealthCritical, checks["marathon-health:app_app.1_8080"].Status)
+
+	// when
+	_, err = consul.Deregister(consul.ServiceId(task), task.Host)
+
+	// then
+	assert.NoError(t, err)
+	services, _ = agent.Agent().Services()
+	assert.Empty(t, services)
+	assert.Empty(t, consul.taskServices)
+}
+
+func TestTaskServiceIdIsFoundInAgentAfterRestart(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	previous := ConsulClientAtServer(server)
+	previous.config.ServiceIdTemplate = "{{.Name}}_{{.TaskID}}_{{.Port}}"
+	app := &apps.App{ID: "/app", Labels: map[string]string{"consul": "true"}}
+	task := tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.1", Ports: []int{8080}}
+	assert.NoError(t, outcomeErr(previous.RegisterTask(task, app)))
+
+	// given
+	consul := ConsulClientAtServer(server)
+
+	// when
+	serviceId := consul.TaskServiceId(task)
+
+	// then
+	assert.Equal(t, "app_app.1_8080", serviceId)
+
+	// when
+	_, err := consul.Deregister(serviceId, task.Host)
+
+	// then
+	assert.NoError(t, err)
+	agent, _ := consul.agents.GetAgent("127.0.0.1")
+	services, _ := agent.Agent().Services()
+	assert.Empty(t, services)
+}
+
+func TestTaskServiceIdFallsBackToTemplate(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	consul.config.ServiceIdTemplate = "{{.Name}}_{{.TaskID}}_{{.Port}}"
+
+	// given
+	task := tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.1", Ports: []int{8080}}
+
+	// when
+	serviceId := consul.TaskServiceId(task)
+
+	// then
+	assert.Equal(t, "app_app.1_8080", serviceId)
+}
+
+func TestRegisterTaskRejectsInvalidCheckMethod(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+
+	// given
+	app := &apps.App{
+		ID:           "/app",
+		Labels:       map[string]string{"consul": "true", "consul.check.method": "P0ST"},
+		HealthChecks: []apps.HealthCheck{{Protocol: "HTTP", Path: "/health"}},
+	}
+	task := tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.1", Ports: []int{8080}}
+
+	// when
+	outcome, err := consul.RegisterTask(task, app)
+
+	// then
+	assert.Error(t, err)
+	assert.Equal(t, RegistrationFailed, outcome)
+	agent, _ := consul.agents.GetAgent("127.0.0.1")
+	services, _ := agent.Agent().Services()
+	assert.Empty(t, services)
+}
+
+func TestBuildRegistrations(t *testing.T) {
+	t.Parallel()
+	// given
+	consul := consulClientAtAddress("127.0.0.1", 8500)
+	consul.config.TagFromConstraints = []string{"rack_id"}
+	app := &apps.App{
+		ID:           "/app",
+		Labels:       map[string]string{"consul": "true", "public": "tag"},
+		HealthChecks: []apps.HealthCheck{{Protocol: "HTTP", Path: "/health", IntervalSeconds: 10}},
+		Constraints:  [][]string{{"rack_id", "CLUSTER", "rack-1"}},
+	}
+	task := tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.1", Ports: []int{8080}}
+
+	// when
+	registrations, err := consul.BuildRegistrations(task, app)
+
+	// then
+	assert.NoError(t, err)
+	assert.Len(t, registrations, 1)
+	assert.Equal(t, "app.1", registrations[0].ID)
+	assert.Equal(t, "app", registrations[0].Name)
+	assert.Equal(t, 8080, registrations[0].Port)
+	assert.Equal(t, []string{"marathon", "public", "rack_id:CLUSTER:rack-1"}, registrations[0].Tags)
+	assert.Equal(t, "http://127.0.0.1:8080/health", registrations[0].Check.HTTP)
+	assert.Empty(t, consul.nameOwners)
+}
+
+func TestBuildRegistrationsOfSocketService(t *testing.T) {
+	t.Parallel()
+	// given
+	consul := consulClientAtAddress("127.0.0.1", 8500)
+	app := &apps.App{ID: "/app", Labels: map[string]string{"consul": "true", "consul.socketPath": "/run/app.sock"}}
+	task := tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.1"}
+
+	// when
+	registrations, err := consul.BuildRegistrations(task, app)
+
+	// then
+	assert.NoError(t, err)
+	assert.Equal(t, "/run/app.sock", registrations[0].SocketPath)
+	assert.Nil(t, registrations[0].Check)
+}
+
+func TestBuildRegistrationsOfTaskWithoutPorts(t *testing.T) {
+	t.Parallel()
+	// given
+	consul := consulClientAtAddress("127.0.0.1", 8500)
+	app := &apps.App{ID: "/app", Labels: map[string]string{"consul": "true"}}
+	task := tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.1"}
+
+	// when
+	_, err := consul.BuildRegistrations(task, app)
+
+	// then
+	assert.Error(t, err)
+	assert.Error(t, outcomeErr(consul.RegisterTask(task, app)))
+}
+
+func TestRegisterTaskWithMeta(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	consul.config.MetaFromLabels = []string{"owner"}
+
+	// given
+	app := &apps.App{ID: "/app", Labels: map[string]string{"consul": "true", "owner": "ops", "public": "tag"}}
+	task := tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.1", Ports: []int{8080}}
+
+	// when
+	_, err := consul.RegisterTask(task, app)
+
+	// then
+	assert.NoError(t, err)
+	services, _ := consul.GetAllServices()
+	assert.Len(t, services, 1)
+	assert.Equal(t, map[string]string{TaskIdMetaKey: "app.1", AppIdMetaKey: "/app", "owner": "ops"}, services[0].ServiceMeta)
+	assert.Equal(t, []string{"marathon", "public"}, services[0].ServiceTags)
+}
+
+// Drops registration or deregistration outcome so error can be asserted inline
+func outcomeErr(_ interface{}, err error) error {
+	return err
+}
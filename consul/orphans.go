@@ -0,0 +1,34 @@
+package consul
+
+import (
+	"github.com/allegro/marathon-consul/tasks"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Fetches marathon services from all datacenters and returns those not matching any of live tasks
+func (c *Consul) FindOrphaned(liveTasks []tasks.Task) ([]*consulapi.CatalogService, error) {
+	services, err := c.GetAllServices()
+	if err != nil {
+		return nil, err
+	}
+	var liveServiceIds []string
+	for _, task := range liveTasks {
+		liveServiceIds = append(liveServiceIds, c.ServiceId(task))
+	}
+	return OrphanedServices(services, liveServiceIds), nil
+}
+
+// Returns services whose IDs are not among service IDs of live tasks
+func OrphanedServices(services []*consulapi.CatalogService, liveServiceIds []string) []*consulapi.CatalogService {
+	live := make(map[string]struct{}, len(liveServiceIds))
+	for _, serviceId := range liveServiceIds {
+		live[serviceId] = struct{}{}
+	}
+	var orphaned []*consulapi.CatalogService
+	for _, service := range services {
+		if _, ok := live[service.ServiceID]; !ok {
+			orphaned = append(orphaned, service)
+		}
+	}
+	return orphaned
+}
@@ -0,0 +1,63 @@
+package consul
+
+import (
+	"github.com/allegro/marathon-consul/tasks"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestOrphanedServices(t *testing.T) {
+	t.Parallel()
+	// given
+	longTaskId := "app." + strings.Repeat("x", maxServiceIdLength)
+	services := []*consulapi.CatalogService{
+		{ServiceID: "app.1"},
+		{ServiceID: "app.2"},
+		{ServiceID: ServiceId(longTaskId)},
+	}
+
+	// when
+	orphaned := OrphanedServices(services, []string{"app.1", ServiceId(longTaskId)})
+
+	// then
+	assert.Len(t, orphaned, 1)
+	assert.Equal(t, "app.2", orphaned[0].ServiceID)
+}
+
+func TestFindOrphanedInAllDatacenters(t *testing.T) {
+	t.Parallel()
+	server1 := CreateConsulTestServer("dc1", t)
+	defer server1.Stop()
+	server2 := CreateConsulTestServer("dc2", t)
+	defer server2.Stop()
+	server1.JoinWAN(server2.LANAddr)
+
+	consul := ConsulClientAtServer(server1)
+
+	// given
+	server1.AddService("app.1", "passing", []string{"marathon"})
+	server2.AddService("app.2", "passing", []string{"marathon"})
+	server2.AddService("zookeeper", "passing", []string{"zookeeper"})
+
+	// when
+	orphaned, err := consul.FindOrphaned([]tasks.Task{{ID: "app.1"}})
+
+	// then
+	assert.NoError(t, err)
+	assert.Len(t, orphaned, 1)
+	assert.Equal(t, "app.2", orphaned[0].ServiceID)
+}
+
+func TestFindOrphanedWhenConsulIsUnavailable(t *testing.T) {
+	t.Parallel()
+	// given
+	consul := consulClientAtAddress("127.0.0.1", 1)
+
+	// when
+	_, err := consul.FindOrphaned([]tasks.Task{{ID: "app.1"}})
+
+	// then
+	assert.Error(t, err)
+}
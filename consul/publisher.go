@@ -0,0 +1,117 @@
+package consul
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/allegro/marathon-consul/metrics"
+)
+
+const (
+	ServiceRegistered   = "service_registered"
+	ServiceDeregistered = "service_deregistered"
+)
+
+// Number of events waiting for webhook before new ones are dropped
+const eventsBufferSize = 100
+
+var ErrEventsBufferFull = errors.New("Events buffer is full, event dropped")
+
+type ServiceEvent struct {
+	Type      string   `json:"type"`
+	ServiceID string   `json:"serviceId"`
+	Name      string   `json:"name,omitempty"`
+	Address   string   `json:"address,omitempty"`
+	Port      int      `json:"port,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+// Publisher is notified after every successful registration and deregistration
+type Publisher interface {
+	Publish(event ServiceEvent) error
+}
+
+type NoopPublisher struct{}
+
+func (p NoopPublisher) Publish(event ServiceEvent) error {
+	return nil
+}
+
+// WebhookPublisher POSTs events as JSON to the configured URL
+type WebhookPublisher struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookPublisher(url string) *WebhookPublisher {
+	return &WebhookPublisher{
+		url:    url,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (p *WebhookPublisher) Publish(event ServiceEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	response, err := p.client.Post(p.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("Webhook %s responded with %d", p.url, response.StatusCode)
+	}
+	return nil
+}
+
+// AsyncPublisher queues events in bounded buffer drained by single goroutine
+// so slow publisher does not block registrations, events are dropped when buffer is full
+type AsyncPublisher struct {
+	publisher Publisher
+	events    chan ServiceEvent
+}
+
+func NewAsyncPublisher(publisher Publisher, bufferSize int) *AsyncPublisher {
+	p := &AsyncPublisher{
+		publisher: publisher,
+		events:    make(chan ServiceEvent, bufferSize),
+	}
+	go p.drain()
+	return p
+}
+
+func (p *AsyncPublisher) Publish(event ServiceEvent) error {
+	select {
+	case p.events <- event:
+		return nil
+	default:
+		metrics.Mark("consul.publish.dropped")
+		return ErrEventsBufferFull
+	}
+}
+
+func (p *AsyncPublisher) drain() {
+	for event := range p.events {
+		if err := p.publisher.Publish(event); err != nil {
+			metrics.Mark("consul.publish.error")
+			log.WithError(err).WithFields(log.Fields{
+				"Type": event.Type,
+				"Id":   event.ServiceID,
+			}).Warn("Unable to publish event")
+		}
+	}
+}
+
+func newPublisher(config ConsulConfig) Publisher {
+	if config.EventsWebhook != "" {
+		return NewAsyncPublisher(NewWebhookPublisher(config.EventsWebhook), eventsBufferSize)
+	}
+	return NoopPublisher{}
+}
@@ -0,0 +1,108 @@
+package consul
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookPublisherPostsEvent(t *testing.T) {
+	t.Parallel()
+	// given
+	var received ServiceEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer server.Close()
+	publisher := NewWebhookPublisher(server.URL)
+
+	// when
+	err := publisher.Publish(ServiceEvent{
+		Type:      ServiceRegistered,
+		ServiceID: "serviceA.1",
+		Name:      "serviceA",
+		Address:   "127.0.0.1",
+		Port:      8080,
+		Tags:      []string{"marathon"},
+	})
+
+	// then
+	assert.NoError(t, err)
+	assert.Equal(t, ServiceRegistered, received.Type)
+	assert.Equal(t, "serviceA.1", received.ServiceID)
+	assert.Equal(t, 8080, received.Port)
+	assert.Equal(t, []string{"marathon"}, received.Tags)
+}
+
+func TestWebhookPublisherFailsOnErrorResponse(t *testing.T) {
+	t.Parallel()
+	// given
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer server.Close()
+	publisher := NewWebhookPublisher(server.URL)
+
+	// when
+	err := publisher.Publish(ServiceEvent{Type: ServiceDeregistered, ServiceID: "serviceA.1"})
+
+	// then
+	assert.Error(t, err)
+}
+
+type blockingPublisher struct {
+	release   chan struct{}
+	published chan ServiceEvent
+}
+
+func (p blockingPublisher) Publish(event ServiceEvent) error {
+	<-p.release
+	p.published <- event
+	return nil
+}
+
+func TestAsyncPublisherDoesNotWaitForPublisher(t *testing.T) {
+	t.Parallel()
+	// given
+	inner := blockingPublisher{release: make(chan struct{}), published: make(chan ServiceEvent, 1)}
+	publisher := NewAsyncPublisher(inner, 1)
+
+	// when
+	err := publisher.Publish(ServiceEvent{Type: ServiceRegistered, ServiceID: "serviceA.1"})
+
+	// then
+	assert.NoError(t, err)
+
+	// when
+	close(inner.release)
+
+	// then
+	select {
+	case event := <-inner.published:
+		assert.Equal(t, "serviceA.1", event.ServiceID)
+	case <-time.After(time.Second):
+		t.Fatal("event was not published")
+	}
+}
+
+func TestAsyncPublisherDropsEventsWhenBufferIsFull(t *testing.T) {
+	t.Parallel()
+	// given
+	inner := blockingPublisher{release: make(chan struct{}), published: make(chan ServiceEvent, 3)}
+	defer close(inner.release)
+	publisher := NewAsyncPublisher(inner, 1)
+	dropped := meterCount("consul.publish.dropped")
+
+	// when
+	var errs []error
+	for i := 0; i < 3; i++ {
+		errs = append(errs, publisher.Publish(ServiceEvent{Type: ServiceRegistered, ServiceID: "serviceA.1"}))
+	}
+
+	// then
+	assert.Contains(t, errs, ErrEventsBufferFull)
+	assert.True(t, meterCount("consul.publish.dropped") > dropped)
+}
@@ -0,0 +1,109 @@
+package consul
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/allegro/marathon-consul/apps"
+	"github.com/allegro/marathon-consul/metrics"
+	"strconv"
+)
+
+const quorumMaintenanceReason = "Waiting for minimum number of healthy instances"
+
+// Number of healthy instances app services need before they are discoverable,
+// taken from minHealthyInstances label (0 when not set or invalid)
+func minHealthyInstances(labels map[string]string, config *ConsulConfig) int {
+	value, ok := labels[config.label("minHealthyInstances")]
+	if !ok {
+		return 0
+	}
+	min, err := strconv.Atoi(value)
+	if err != nil || min < 0 {
+		log.WithField("Value", value).Warn("Invalid minimum healthy instances label, ignoring")
+		return 0
+	}
+	return min
+}
+
+// Keeps services of app registered by this instance in maintenance, so they are
+// excluded from discovery, until minimum number of its instances is healthy.
+// Consul requires passing weight of at least 1, so maintenance is used instead of zero weight.
+func (c *Consul) enforceMinHealthyInstances(app *apps.App) {
+	min := minHealthyInstances(app.Labels, c.config)
+	if min == 0 {
+		c.releaseQuorumMaintenance(app)
+		return
+	}
+	var registered []string
+	healthy := 0
+	for _, task := range app.Tasks {
+		serviceId := serviceId(task, c.config)
+		if _, ok := c.registrations.get(serviceId); !ok {
+			continue
+		}
+		registered = append(registered, serviceId)
+		if IsTaskHealthy(task.HealthCheckResults) {
+			healthy++
+		}
+	}
+	quorate := healthy >= min
+	for _, serviceId := range registered {
+		c.setQuorumMaintenance(serviceId, !quorate)
+	}
+}
+
+// Services kept in maintenance are released when app no longer requires minimum healthy instances
+func (c *Consul) releaseQuorumMaintenance(app *apps.App) {
+	for _, task := range app.Tasks {
+		serviceId := serviceId(task, c.config)
+		if enabled, _ := c.quorumMaintenanceState(serviceId); enabled {
+			c.setQuorumMaintenance(serviceId, false)
+		}
+	}
+}
+
+// Maintenance state set by this instance, not known for services
+// it did not change yet (e.g. put in maintenance before restart)
+func (c *Consul) quorumMaintenanceState(serviceId string) (enabled bool, known bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	enabled, known = c.quorumMaintenance[serviceId]
+	return enabled, known
+}
+
+func (c *Consul) forgetQuorumMaintenance(serviceId string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.quorumMaintenance, serviceId)
+}
+
+// Agent is called whenever state is not known, so services are not left in maintenance
+// by previous process. Lock is not held during agent calls.
+func (c *Consul) setQuorumMaintenance(serviceId string, enabled bool) {
+	if current, known := c.quorumMaintenanceState(serviceId); known && current == enabled {
+		return
+	}
+	agentAddress, _ := c.registrations.agent(serviceId)
+	agent, err := c.agents.GetAgent(agentAddress)
+	if err != nil {
+		log.WithError(err).WithField("Id", serviceId).Warn("Unable to change service maintenance")
+		return
+	}
+	if enabled {
+		err = agent.Agent().EnableServiceMaintenance(serviceId, quorumMaintenanceReason)
+	} else {
+		err = agent.Agent().DisableServiceMaintenance(serviceId)
+	}
+	if err != nil {
+		log.WithError(err).WithField("Id", serviceId).Warn("Unable to change service maintenance")
+		return
+	}
+	if enabled {
+		metrics.Mark("consul.quorum.maintenance_enabled")
+	} else {
+		metrics.Mark("consul.quorum.maintenance_disabled")
+	}
+	c.lock.Lock()
+	c.quorumMaintenance[serviceId] = enabled
+	c.lock.Unlock()
+	log.WithFields(log.Fields{"Id": serviceId, "Maintenance": enabled}).Info("Changed service maintenance")
+}
@@ -0,0 +1,139 @@
+package consul
+
+import (
+	"github.com/allegro/marathon-consul/apps"
+	"github.com/allegro/marathon-consul/tasks"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMinHealthyInstances(t *testing.T) {
+	t.Parallel()
+	config := &ConsulConfig{}
+	assert.Equal(t, 3, minHealthyInstances(map[string]string{"consul.minHealthyInstances": "3"}, config))
+	assert.Equal(t, 0, minHealthyInstances(map[string]string{"consul.minHealthyInstances": "three"}, config))
+	assert.Equal(t, 0, minHealthyInstances(map[string]string{"consul.minHealthyInstances": "-1"}, config))
+	assert.Equal(t, 0, minHealthyInstances(map[string]string{}, config))
+}
+
+func TestServicesAreInMaintenanceUntilMinHealthyInstances(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	agent, _ := consul.agents.GetAgent("127.0.0.1")
+	inMaintenance := func(serviceId string) bool {
+		checks, _ := agent.Agent().Checks()
+		_, ok := checks["_service_maintenance:"+serviceId]
+		return ok
+	}
+	healthy := []tasks.HealthCheckResult{{Alive: true}}
+
+	// given
+	app := &apps.App{ID: "/app", Labels: map[string]string{"consul": "true", "consul.minHealthyInstances": "2"}}
+	first := tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.1", Ports: []int{8080}, HealthCheckResults: healthy}
+	second := tasks.Task{ID: "app.2", AppID: "/app", Host: "127.0.0.1", Ports: []int{8081}, HealthCheckResults: healthy}
+
+	// when first instance is registered
+	app.Tasks = []tasks.Task{first}
+	assert.NoError(t, outcomeErr(consul.RegisterTask(first, app)))
+
+	// then
+	assert.True(t, inMaintenance("app.1"))
+
+	// when threshold is met
+	app.Tasks = []tasks.Task{first, second}
+	assert.NoError(t, outcomeErr(consul.RegisterTask(second, app)))
+
+	// then
+	assert.False(t, inMaintenance("app.1"))
+	assert.False(t, inMaintenance("app.2"))
+
+	// when instance becomes unhealthy
+	app.Tasks[1].HealthCheckResults = []tasks.HealthCheckResult{{Alive: false}}
+	assert.NoError(t, outcomeErr(consul.RegisterTask(first, app)))
+
+	// then
+	assert.True(t, inMaintenance("app.1"))
+	assert.True(t, inMaintenance("app.2"))
+}
+
+func TestServicesLeftInMaintenanceByPreviousProcessAreReleased(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	agent, _ := consul.agents.GetAgent("127.0.0.1")
+	healthy := []tasks.HealthCheckResult{{Alive: true}}
+
+	// given
+	task := tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.1", Ports: []int{8080}, HealthCheckResults: healthy}
+	app := &apps.App{
+		ID:     "/app",
+		Labels: map[string]string{"consul": "true", "consul.minHealthyInstances": "1"},
+		Tasks:  []tasks.Task{task},
+	}
+	// previous process registered the service and put it in maintenance
+	agent.Agent().ServiceRegister(&consulapi.AgentServiceRegistration{ID: "app.1", Name: "app", Port: 8080})
+	agent.Agent().EnableServiceMaintenance("app.1", quorumMaintenanceReason)
+
+	// when
+	_, err := consul.RegisterTask(task, app)
+
+	// then
+	assert.NoError(t, err)
+	checks, _ := agent.Agent().Checks()
+	assert.NotContains(t, checks, "_service_maintenance:app.1")
+}
+
+func TestServicesAreReleasedWhenMinHealthyInstancesLabelIsRemoved(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	agent, _ := consul.agents.GetAgent("127.0.0.1")
+
+	// given
+	task := tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.1", Ports: []int{8080}}
+	app := &apps.App{
+		ID:     "/app",
+		Labels: map[string]string{"consul": "true", "consul.minHealthyInstances": "2"},
+		Tasks:  []tasks.Task{task},
+	}
+	assert.NoError(t, outcomeErr(consul.RegisterTask(task, app)))
+
+	// when
+	delete(app.Labels, "consul.minHealthyInstances")
+	_, err := consul.RegisterTask(task, app)
+
+	// then
+	assert.NoError(t, err)
+	checks, _ := agent.Agent().Checks()
+	assert.NotContains(t, checks, "_service_maintenance:app.1")
+}
+
+func TestServicesWithoutMinHealthyInstancesAreNotInMaintenance(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+
+	// given
+	task := tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.1", Ports: []int{8080}}
+	app := &apps.App{ID: "/app", Labels: map[string]string{"consul": "true"}, Tasks: []tasks.Task{task}}
+
+	// when
+	_, err := consul.RegisterTask(task, app)
+
+	// then
+	assert.NoError(t, err)
+	agent, _ := consul.agents.GetAgent("127.0.0.1")
+	checks, _ := agent.Agent().Checks()
+	assert.NotContains(t, checks, "_service_maintenance:app.1")
+	assert.Empty(t, consul.quorumMaintenance)
+}
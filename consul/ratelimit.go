@@ -0,0 +1,39 @@
+package consul
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/allegro/marathon-consul/metrics"
+	consulapi "github.com/hashicorp/consul/api"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Retries write rate limited by Consul with doubling backoff.
+// Consul API client does not expose response headers, so Retry-After
+// can not be honoured and configured backoff is used instead.
+func (c *Consul) withRateLimitRetries(operation string, write func() error) error {
+	backoff := c.config.RateLimitBackoff
+	err := write()
+	for attempt := 0; attempt < c.config.RateLimitRetries && isRateLimited(err); attempt++ {
+		metrics.Mark("consul." + operation + ".rate_limited")
+		log.WithError(err).WithFields(log.Fields{
+			"Operation": operation, "Backoff": backoff,
+		}).Warn("Rate limited by Consul, retrying")
+		time.Sleep(backoff)
+		backoff *= 2
+		err = write()
+	}
+	return err
+}
+
+// Rate limiting is a server side throttle, not a problem of the agent
+func isRateLimited(err error) bool {
+	if err == nil {
+		return false
+	}
+	if statusErr, ok := err.(consulapi.StatusError); ok {
+		return statusErr.Code == http.StatusTooManyRequests
+	}
+	return strings.Contains(err.Error(), "Unexpected response code: 429")
+}
@@ -0,0 +1,83 @@
+package consul
+
+import (
+	"errors"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestIsRateLimited(t *testing.T) {
+	t.Parallel()
+	assert.True(t, isRateLimited(consulapi.StatusError{Code: 429, Body: "rate limit exceeded"}))
+	assert.True(t, isRateLimited(errors.New("Unexpected response code: 429 (rate limit exceeded)")))
+	assert.False(t, isRateLimited(consulapi.StatusError{Code: 500, Body: "error"}))
+	assert.False(t, isRateLimited(errors.New("connection refused")))
+	assert.False(t, isRateLimited(nil))
+}
+
+func TestRateLimitedWriteIsRetriedWithBackoff(t *testing.T) {
+	t.Parallel()
+	// given
+	consul := consulClientAtAddress("127.0.0.1", 8500)
+	consul.config.RateLimitRetries = 3
+	consul.config.RateLimitBackoff = 10 * time.Millisecond
+	attempts := 0
+	write := func() error {
+		attempts++
+		if attempts < 3 {
+			return consulapi.StatusError{Code: 429, Body: "rate limit exceeded"}
+		}
+		return nil
+	}
+
+	rateLimited := meterCount("consul.register.rate_limited")
+
+	// when
+	start := time.Now()
+	err := consul.withRateLimitRetries("register", write)
+
+	// then
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.True(t, time.Since(start) >= 30*time.Millisecond)
+	assert.Equal(t, rateLimited+2, meterCount("consul.register.rate_limited"))
+}
+
+func TestRateLimitedWriteGivesUpAfterRetries(t *testing.T) {
+	t.Parallel()
+	// given
+	consul := consulClientAtAddress("127.0.0.1", 8500)
+	consul.config.RateLimitRetries = 2
+	consul.config.RateLimitBackoff = time.Millisecond
+	attempts := 0
+
+	// when
+	err := consul.withRateLimitRetries("deregister", func() error {
+		attempts++
+		return consulapi.StatusError{Code: 429, Body: "rate limit exceeded"}
+	})
+
+	// then
+	assert.True(t, isRateLimited(err))
+	assert.Equal(t, 3, attempts)
+}
+
+func TestOtherWriteErrorsAreNotRetried(t *testing.T) {
+	t.Parallel()
+	// given
+	consul := consulClientAtAddress("127.0.0.1", 8500)
+	consul.config.RateLimitRetries = 3
+	attempts := 0
+
+	// when
+	err := consul.withRateLimitRetries("register", func() error {
+		attempts++
+		return errors.New("connection refused")
+	})
+
+	// then
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
@@ -0,0 +1,78 @@
+package consul
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/allegro/marathon-consul/metrics"
+	consulapi "github.com/hashicorp/consul/api"
+	"time"
+)
+
+// Periodically re-asserts registrations made by this instance so services
+// lost by agents (e.g. after agent restart) come back before the next sync.
+func (c *Consul) StartRegistrationRefresher(interval time.Duration) *time.Ticker {
+	log.WithField("Interval", interval).Info("Registration refresher started")
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			c.refreshRegistrations()
+		}
+	}()
+	return ticker
+}
+
+// Forgets registrations of tasks missing from Marathon, so services Consul reaped
+// for tasks whose death was missed are not refreshed back
+func (c *Consul) PruneRegistrations(liveServiceIds []string) {
+	if pruned := c.registrations.retain(liveServiceIds); pruned > 0 {
+		metrics.Mark("consul.registrations.pruned")
+		log.WithField("Count", pruned).Info("Forgot registrations of tasks missing from Marathon")
+	}
+}
+
+func (c *Consul) refreshRegistrations() {
+	for address, services := range c.registrations.byAgent() {
+		c.refreshAgentRegistrations(address, services)
+	}
+}
+
+// Registers services agent does not know about, services present on agent are left untouched.
+// Agent lost standalone checks and maintenance of missing services too, they are set again.
+func (c *Consul) refreshAgentRegistrations(address string, services []*consulapi.AgentServiceRegistration) {
+	agent, err := c.agents.GetAgent(address)
+	if err != nil {
+		log.WithError(err).WithField("Address", address).Error("Can't get agent to refresh registrations")
+		return
+	}
+	registered, err := agent.Agent().Services()
+	if err != nil {
+		log.WithError(err).WithField("Address", address).Error("Can't get services registered in agent")
+		return
+	}
+	for _, service := range services {
+		if _, ok := registered[service.ID]; ok {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"Id": service.ID, "Address": address,
+		}).Info("Service missing from agent, registering again")
+		checkUrl := c.standaloneCheckUrl(service.ID)
+		maintenance, _ := c.quorumMaintenanceState(service.ID)
+		c.forgetStandaloneCheck(service.ID)
+		c.forgetQuorumMaintenance(service.ID)
+		c.registrations.invalidate(service.ID)
+		if _, err := c.registerPrepared(address, service); err != nil {
+			metrics.Mark("consul.refresh.error")
+			log.WithError(err).WithField("Id", service.ID).Error("Can't register service again")
+			continue
+		}
+		if checkUrl != "" {
+			if err := c.registerStandaloneCheckUrl(service, checkUrl); err != nil {
+				log.WithError(err).WithField("Id", service.ID).Warn("Can't register standalone check again")
+			}
+		}
+		if maintenance {
+			c.setQuorumMaintenance(service.ID, true)
+		}
+		metrics.Mark("consul.refresh.registered")
+	}
+}
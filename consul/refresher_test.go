@@ -0,0 +1,178 @@
+package consul
+
+import (
+	"github.com/allegro/marathon-consul/apps"
+	"github.com/allegro/marathon-consul/tasks"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRefreshRegistrationsRegistersMissingServices(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+
+	// given
+	for _, id := range []string{"serviceA", "serviceB"} {
+		consul.Register(&consulapi.AgentServiceRegistration{
+			ID:      id,
+			Name:    id,
+			Address: "127.0.0.1",
+			Port:    8080,
+			Tags:    []string{"marathon"},
+		})
+	}
+	agent, _ := consul.agents.GetAgent("127.0.0.1")
+	agent.Agent().ServiceDeregister("serviceA")
+
+	// when
+	consul.refreshRegistrations()
+
+	// then
+	services, _ := agent.Agent().Services()
+	assert.Len(t, services, 2)
+	assert.Contains(t, services, "serviceA")
+	assert.Contains(t, services, "serviceB")
+}
+
+func TestRefreshRegistrationsRestoresStandaloneCheckAndMaintenance(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	agent, _ := consul.agents.GetAgent("127.0.0.1")
+
+	// given service in maintenance waiting for second healthy instance
+	task := tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.1", Ports: []int{8080}, HealthCheckResults: []tasks.HealthCheckResult{{Alive: true}}}
+	app := &apps.App{
+		ID: "/app",
+		Labels: map[string]string{
+			"consul":                     "true",
+			"consul.minHealthyInstances": "2",
+			"consul.standaloneCheck":     "http://{{.Host}}:9090/ready",
+		},
+		Tasks: []tasks.Task{task},
+	}
+	assert.NoError(t, outcomeErr(consul.RegisterTask(task, app)))
+	// agent restarted and lost service with its checks
+	agent.Agent().ServiceDeregister("app.1")
+	agent.Agent().CheckDeregister(standaloneCheckId("app.1"))
+	agent.Agent().DisableServiceMaintenance("app.1")
+
+	// when
+	consul.refreshRegistrations()
+
+	// then
+	services, _ := agent.Agent().Services()
+	assert.Contains(t, services, "app.1")
+	checks, _ := agent.Agent().Checks()
+	assert.Contains(t, checks, "standalone:app.1")
+	assert.Contains(t, checks, "_service_maintenance:app.1")
+}
+
+func TestRefreshRegistrationsSkipsPrunedServices(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+
+	// given
+	for _, id := range []string{"serviceA", "serviceB"} {
+		consul.Register(&consulapi.AgentServiceRegistration{
+			ID:      id,
+			Name:    id,
+			Address: "127.0.0.1",
+			Port:    8080,
+			Tags:    []string{"marathon"},
+		})
+	}
+	// serviceA task died with missed event and Consul reaped its service
+	agent, _ := consul.agents.GetAgent("127.0.0.1")
+	agent.Agent().ServiceDeregister("serviceA")
+	consul.PruneRegistrations([]string{"serviceB"})
+
+	// when
+	consul.refreshRegistrations()
+
+	// then
+	services, _ := agent.Agent().Services()
+	assert.Len(t, services, 1)
+	assert.Contains(t, services, "serviceB")
+}
+
+func TestRefreshRegistrationsSkipsServicesPresentInAgent(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+
+	// given
+	service := &consulapi.AgentServiceRegistration{
+		ID:      "serviceA",
+		Name:    "serviceA",
+		Address: "127.0.0.1",
+		Port:    8080,
+		Tags:    []string{"marathon"},
+	}
+	consul.Register(service)
+	agent, _ := consul.agents.GetAgent("127.0.0.1")
+	// change registration in agent behind our back, refresh must not override it
+	agent.Agent().ServiceRegister(&consulapi.AgentServiceRegistration{
+		ID:      "serviceA",
+		Name:    "serviceA",
+		Address: "127.0.0.1",
+		Port:    9090,
+		Tags:    []string{"marathon"},
+	})
+
+	// when
+	consul.refreshRegistrations()
+
+	// then
+	services, _ := agent.Agent().Services()
+	assert.Equal(t, 9090, services["serviceA"].Port)
+}
+
+func TestRegistrationRefresherRunsPeriodically(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+
+	// given
+	consul.Register(&consulapi.AgentServiceRegistration{
+		ID:      "serviceA",
+		Name:    "serviceA",
+		Address: "127.0.0.1",
+		Port:    8080,
+		Tags:    []string{"marathon"},
+	})
+	agent, _ := consul.agents.GetAgent("127.0.0.1")
+	agent.Agent().ServiceDeregister("serviceA")
+
+	// when
+	ticker := consul.StartRegistrationRefresher(5 * time.Millisecond)
+	defer ticker.Stop()
+
+	// then
+	deadline := time.After(time.Second)
+	for {
+		services, _ := agent.Agent().Services()
+		if _, ok := services["serviceA"]; ok {
+			return
+		}
+		select {
+		case <-deadline:
+			t.Fatal("Service was not registered again")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
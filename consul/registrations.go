@@ -0,0 +1,173 @@
+package consul
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	consulapi "github.com/hashicorp/consul/api"
+	"sync"
+)
+
+// Keeps services successfully registered by this instance together with
+// their content hashes so unchanged registrations can be skipped.
+type registrations struct {
+	entries map[string]registration
+	lock    sync.Mutex
+}
+
+type registration struct {
+	hash    string
+	service *consulapi.AgentServiceRegistration
+	agent   string
+}
+
+func newRegistrations() *registrations {
+	return &registrations{
+		entries: make(map[string]registration),
+	}
+}
+
+// Service is unchanged when the same content was registered in the same agent
+func (r *registrations) unchanged(service *consulapi.AgentServiceRegistration, agent string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entry, ok := r.entries[service.ID]
+	return ok && entry.agent == agent && entry.hash == registrationHash(service)
+}
+
+// Services removed from Consul behind our back (manual deregistration, agent wipe,
+// reaping of critical services) are registered again on next registration attempt.
+// Entries are kept so agents of services are still known.
+func (r *registrations) invalidateMissing(services []*consulapi.CatalogService) int {
+	present := make(map[string]struct{}, len(services))
+	for _, service := range services {
+		present[service.ServiceID] = struct{}{}
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	invalidated := 0
+	for id, entry := range r.entries {
+		if _, ok := present[id]; !ok && entry.hash != "" {
+			entry.hash = ""
+			r.entries[id] = entry
+			invalidated++
+		}
+	}
+	return invalidated
+}
+
+// Forgets hash of service, so it is registered again even when unchanged
+func (r *registrations) invalidate(serviceId string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if entry, ok := r.entries[serviceId]; ok {
+		entry.hash = ""
+		r.entries[serviceId] = entry
+	}
+}
+
+func (r *registrations) get(serviceId string) (*consulapi.AgentServiceRegistration, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entry, ok := r.entries[serviceId]
+	return entry.service, ok
+}
+
+// Returns address of agent service was registered in
+func (r *registrations) agent(serviceId string) (string, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entry, ok := r.entries[serviceId]
+	return entry.agent, ok
+}
+
+// Returns registered services grouped by agent address
+func (r *registrations) byAgent() map[string][]*consulapi.AgentServiceRegistration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	services := make(map[string][]*consulapi.AgentServiceRegistration)
+	for _, entry := range r.entries {
+		services[entry.agent] = append(services[entry.agent], entry.service)
+	}
+	return services
+}
+
+// Tells whether any service of app is registered
+func (r *registrations) hasApp(appId string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, entry := range r.entries {
+		if entry.service.Meta[AppIdMetaKey] == appId {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns ID of service registered for task
+func (r *registrations) byTask(taskId string) (string, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for serviceId, entry := range r.entries {
+		if entry.service.Meta[TaskIdMetaKey] == taskId {
+			return serviceId, true
+		}
+	}
+	return "", false
+}
+
+// Returns number of services registered in agent
+func (r *registrations) countAt(agent string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	count := 0
+	for _, entry := range r.entries {
+		if entry.agent == agent {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *registrations) put(service *consulapi.AgentServiceRegistration, agent string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.entries[service.ID] = registration{
+		hash:    registrationHash(service),
+		service: service,
+		agent:   agent,
+	}
+}
+
+// Removes registrations of services other than given ones, returns number of removed
+func (r *registrations) retain(serviceIds []string) int {
+	keep := make(map[string]struct{}, len(serviceIds))
+	for _, serviceId := range serviceIds {
+		keep[serviceId] = struct{}{}
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	removed := 0
+	for id := range r.entries {
+		if _, ok := keep[id]; !ok {
+			delete(r.entries, id)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (r *registrations) remove(serviceId string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.entries, serviceId)
+}
+
+func registrationHash(service *consulapi.AgentServiceRegistration) string {
+	content, err := json.Marshal(service)
+	if err != nil {
+		return ""
+	}
+	hash := sha1.Sum(content)
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,31 @@
+package consul
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/allegro/marathon-consul/metrics"
+	"time"
+)
+
+// Retries failed read with growing backoff, so a transient failure does not fail the whole operation
+func (c *Consul) withReadRetries(operation string, read func() error) error {
+	backoff := c.config.ReadRetryBackoff
+	err := read()
+	for attempt := 0; attempt < c.config.ReadRetries && err != nil; attempt++ {
+		metrics.Mark("consul." + operation + ".retry")
+		log.WithError(err).WithFields(log.Fields{
+			"Operation": operation, "Backoff": backoff,
+		}).Warn("Consul read failed, retrying")
+		time.Sleep(backoff)
+		backoff = c.nextReadRetryBackoff(backoff)
+		err = read()
+	}
+	return err
+}
+
+func (c *Consul) nextReadRetryBackoff(backoff time.Duration) time.Duration {
+	next := time.Duration(float64(backoff) * c.config.ReadRetryBackoffMultiplier)
+	if c.config.ReadRetryMaxBackoff > 0 && next > c.config.ReadRetryMaxBackoff {
+		return c.config.ReadRetryMaxBackoff
+	}
+	return next
+}
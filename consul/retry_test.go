@@ -0,0 +1,85 @@
+package consul
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestReadFailingOnceIsRetried(t *testing.T) {
+	t.Parallel()
+	// given
+	consul := consulClientAtAddress("127.0.0.1", 8500)
+	consul.config.ReadRetries = 2
+	consul.config.ReadRetryBackoff = time.Millisecond
+	attempts := 0
+	var datacenters []string
+
+	// when
+	err := consul.withReadRetries("test_read", func() error {
+		attempts++
+		if attempts == 1 {
+			return errors.New("connection reset by peer")
+		}
+		datacenters = []string{"dc1"}
+		return nil
+	})
+
+	// then
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, []string{"dc1"}, datacenters)
+}
+
+func TestReadIsNotRetriedWithoutRetries(t *testing.T) {
+	t.Parallel()
+	// given
+	consul := consulClientAtAddress("127.0.0.1", 8500)
+	attempts := 0
+
+	// when
+	err := consul.withReadRetries("test_read", func() error {
+		attempts++
+		return errors.New("connection reset by peer")
+	})
+
+	// then
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestDatacentersDiscoveryGivesUpAfterRetries(t *testing.T) {
+	t.Parallel()
+	// given
+	consul := consulClientAtAddress("127.0.0.1", 1)
+	consul.config.ReadRetries = 2
+	consul.config.ReadRetryBackoff = time.Millisecond
+	agent, _ := consul.agents.GetAgent("127.0.0.1")
+	retries := meterCount("consul.datacenters.retry")
+
+	// when
+	_, err := consul.datacenters(agent)
+
+	// then
+	assert.Error(t, err)
+	assert.Equal(t, retries+2, meterCount("consul.datacenters.retry"))
+}
+
+func TestReadRetryBackoffIsMultipliedUpToMax(t *testing.T) {
+	t.Parallel()
+	// given
+	consul := consulClientAtAddress("127.0.0.1", 8500)
+	consul.config.ReadRetryBackoffMultiplier = 3
+	consul.config.ReadRetryMaxBackoff = time.Second
+
+	// then
+	assert.Equal(t, 300*time.Millisecond, consul.nextReadRetryBackoff(100*time.Millisecond))
+	assert.Equal(t, time.Second, consul.nextReadRetryBackoff(900*time.Millisecond))
+
+	// when max is not set
+	consul.config.ReadRetryMaxBackoff = 0
+
+	// then
+	assert.Equal(t, 2700*time.Millisecond, consul.nextReadRetryBackoff(900*time.Millisecond))
+}
@@ -1,25 +1,234 @@
 package consul
 
 import (
+	log "github.com/Sirupsen/logrus"
 	consulapi "github.com/hashicorp/consul/api"
 
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"github.com/allegro/marathon-consul/apps"
+	"github.com/allegro/marathon-consul/metrics"
 	"github.com/allegro/marathon-consul/tasks"
+	"github.com/allegro/marathon-consul/utils"
+	"net"
+	"net/http"
 	"net/url"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"text/template"
 )
 
+const maxServiceIdLength = 128
+
+// Meta key with ID of task service was registered for
+const TaskIdMetaKey = "marathon-task"
+
+const AppIdMetaKey = "marathon-app"
+
+var invalidMetaKeyChars = regexp.MustCompile(`[^a-zA-Z0-9_\-]`)
+
+var invalidServiceIdChars = regexp.MustCompile(`[^a-zA-Z0-9_.\-]`)
+
+// Service kinds that can be set with serviceKind label
+var knownServiceKinds = []consulapi.ServiceKind{
+	consulapi.ServiceKindTypical,
+	consulapi.ServiceKindConnectProxy,
+	consulapi.ServiceKindMeshGateway,
+	consulapi.ServiceKindTerminatingGateway,
+	consulapi.ServiceKindIngressGateway,
+	consulapi.ServiceKindAPIGateway,
+}
+
+// Health check protocols that can be translated to Consul checks
+var SupportedHealthChecks = []string{"HTTP", "HTTPS", "TCP", "COMMAND"}
+
+// Health check protocols translated when AllowedHealthChecks is not set,
+// other protocols have to be enabled explicitly
+var DefaultHealthChecks = []string{"HTTP"}
+
 func MarathonTaskToConsulService(task tasks.Task, healthChecks []apps.HealthCheck, labels map[string]string) *consulapi.AgentServiceRegistration {
-	return &consulapi.AgentServiceRegistration{
-		ID:      task.ID,
-		Name:    appIdToServiceName(task.AppID),
-		Port:    task.Ports[0],
-		Address: task.Host,
-		Tags:    marathonLabelsToConsulTags(labels),
-		Check:   marathonToConsulCheck(task, healthChecks),
+	return marathonTaskToConsulService(task, healthChecks, labels, &ConsulConfig{})
+}
+
+func marathonTaskToConsulService(task tasks.Task, healthChecks []apps.HealthCheck, labels map[string]string, config *ConsulConfig) *consulapi.AgentServiceRegistration {
+	return appTaskToConsulService(task, &apps.App{ID: task.AppID, Labels: labels, HealthChecks: healthChecks}, config)
+}
+
+func appTaskToConsulService(task tasks.Task, app *apps.App, config *ConsulConfig) *consulapi.AgentServiceRegistration {
+	labels := app.Labels
+	// ID is expanded from Marathon host, as everywhere tasks are matched with services
+	id := serviceId(task, config)
+	task.Host = serviceAddress(task.Host, config)
+	service := &consulapi.AgentServiceRegistration{
+		Kind:      serviceKind(labels, config),
+		ID:        id,
+		Name:      appIdToServiceName(task.AppID, config.ServiceNameSegments),
+		Address:   task.Host,
+		Tags:      serviceTags(task, app, config),
+		Meta:      serviceMeta(task, labels, config),
+		Check:     marathonToConsulCheck(task, app, config),
+		Weights:   serviceWeights(config),
+		Partition: registrationPartition(labels, config),
+	}
+	if config.MarathonHealthCheckTTL > 0 {
+		service.Checks = consulapi.AgentServiceChecks{marathonHealthCheck(service.ID, config)}
+	}
+	// Consul uses agent node address for services registered without one
+	if config.UseAgentAddress {
+		service.Address = ""
+	}
+	// Behind NAT service advertises public address while check still targets task host
+	if publicAddress := labels[config.label("publicAddress")]; publicAddress != "" {
+		service.Address = publicAddress
+	}
+	// Services listening on Unix socket are registered without TCP port
+	if socketPath := labels[config.label("socketPath")]; socketPath != "" {
+		service.SocketPath = socketPath
+	} else {
+		service.Port = task.Ports[0]
+	}
+	return service
+}
+
+// Takes service kind from label, invalid kinds fall back to typical service
+func serviceKind(labels map[string]string, config *ConsulConfig) consulapi.ServiceKind {
+	kind := consulapi.ServiceKind(labels[config.label("serviceKind")])
+	for _, known := range knownServiceKinds {
+		if kind == known {
+			return kind
+		}
+	}
+	log.WithField("Kind", kind).Warn("Unknown service kind, registering typical service")
+	return consulapi.ServiceKindTypical
+}
+
+// Agent running on task host, on port from agentPort label when it is set
+func taskAgentAddress(task tasks.Task, labels map[string]string, config *ConsulConfig) string {
+	value, ok := labels[config.label("agentPort")]
+	if !ok {
+		return task.Host
+	}
+	if port, err := strconv.Atoi(value); err != nil || port <= 0 {
+		log.WithError(err).WithField("Port", value).Warn("Invalid agent port, using default agent port")
+		return task.Host
+	}
+	return net.JoinHostPort(task.Host, value)
+}
+
+func registrationPartition(labels map[string]string, config *ConsulConfig) string {
+	if partition := labels[config.label("partition")]; partition != "" {
+		return partition
+	}
+	return config.Partition
+}
+
+func marathonHealthCheckId(serviceId string) string {
+	return "marathon-health:" + serviceId
+}
+
+// TTL check mirroring task health seen by Marathon, tasks are registered only when healthy
+func marathonHealthCheck(serviceId string, config *ConsulConfig) *consulapi.AgentServiceCheck {
+	return &consulapi.AgentServiceCheck{
+		CheckID: marathonHealthCheckId(serviceId),
+		Name:    "Marathon health",
+		TTL:     config.MarathonHealthCheckTTL.String(),
+		Status:  consulapi.HealthPassing,
+	}
+}
+
+// Resolves task host to an IP address when address selection is configured
+func serviceAddress(host string, config *ConsulConfig) string {
+	if config.AddressSelection == "" {
+		return host
+	}
+	address, err := utils.HostToIPv4(host, config.AddressSelection)
+	if err != nil {
+		log.WithError(err).WithField("Host", host).Warn("Unable to resolve host, using it as service address")
+		return host
+	}
+	return address
+}
+
+// Consul requires passing weight of at least 1, so services that should have
+// their weight ramped down before deregistration or decayed on failures start
+// one weight unit per step above it.
+// All marathon services get the same weight so traffic distribution is not affected.
+func serviceWeights(config *ConsulConfig) *consulapi.AgentWeights {
+	steps := config.DeregisterWeightRampSteps
+	if config.WeightDecaySteps > steps {
+		steps = config.WeightDecaySteps
+	}
+	if steps <= 0 {
+		return nil
+	}
+	weight := steps + 1
+	return &consulapi.AgentWeights{Passing: weight, Warning: weight}
+}
+
+// Fields service ID template is evaluated with
+type serviceIdFields struct {
+	TaskID string
+	AppID  string
+	Name   string
+	Host   string
+	Port   int
+	Task   tasks.Task
+}
+
+// Service ID of task from configured template, task ID when template is not set.
+// Result is sanitized with ServiceId, invalid templates fall back to task ID.
+// Only task fields are used, so app updates do not change IDs of running tasks.
+func serviceId(task tasks.Task, config *ConsulConfig) string {
+	if config.ServiceIdTemplate == "" {
+		return ServiceId(task.ID)
+	}
+	id, err := expandServiceIdTemplate(config.ServiceIdTemplate, task, config)
+	if err != nil || id == "" {
+		log.WithError(err).WithField("Id", task.ID).Warn("Unable to expand service ID template, using task ID")
+		return ServiceId(task.ID)
+	}
+	return ServiceId(id)
+}
+
+func expandServiceIdTemplate(text string, task tasks.Task, config *ConsulConfig) (string, error) {
+	tmpl, err := template.New("serviceId").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	fields := serviceIdFields{
+		TaskID: task.ID,
+		AppID:  task.AppID,
+		Name:   appIdToServiceName(task.AppID, config.ServiceNameSegments),
+		Host:   task.Host,
+		Task:   task,
+	}
+	if len(task.Ports) > 0 {
+		fields.Port = task.Ports[0]
+	}
+	var expanded bytes.Buffer
+	if err := tmpl.Execute(&expanded, fields); err != nil {
+		return "", err
+	}
+	return expanded.String(), nil
+}
+
+// Converts task ID to a service ID accepted by Consul.
+// IDs that need changes get a hash of the original appended to stay unique.
+func ServiceId(taskId string) string {
+	if !invalidServiceIdChars.MatchString(taskId) && len(taskId) <= maxServiceIdLength {
+		return taskId
 	}
+	hash := sha1.Sum([]byte(taskId))
+	suffix := hex.EncodeToString(hash[:])[:8]
+	serviceId := invalidServiceIdChars.ReplaceAllString(taskId, "-")
+	if len(serviceId) > maxServiceIdLength-len(suffix)-1 {
+		serviceId = serviceId[:maxServiceIdLength-len(suffix)-1]
+	}
+	return serviceId + "-" + suffix
 }
 
 func IsTaskHealthy(healthChecksResults []tasks.HealthCheckResult) bool {
@@ -33,38 +242,285 @@ func IsTaskHealthy(healthChecksResults []tasks.HealthCheckResult) bool {
 	return register
 }
 
-// Takes first HTTP check and convert it to consul healtcheck
-// Returns empty check when there is no HTTP check
-func marathonToConsulCheck(task tasks.Task, healthChecks []apps.HealthCheck) *consulapi.AgentServiceCheck {
-	//	TODO: Handle all types of checks
-	for _, check := range healthChecks {
-		if check.Protocol == "HTTP" {
-			return &consulapi.AgentServiceCheck{
-				HTTP: (&url.URL{
-					Scheme: "http",
-					Host:   task.Host + ":" + strconv.Itoa(task.Ports[check.PortIndex]),
-					Path:   check.Path,
-				}).String(),
-				Interval: fmt.Sprintf("%ds", check.IntervalSeconds),
-				Timeout:  fmt.Sprintf("%ds", check.TimeoutSeconds),
+// Takes first supported and allowed check and convert it to consul healtcheck
+// Returns empty check when there is no such check
+func marathonToConsulCheck(task tasks.Task, app *apps.App, config *ConsulConfig) *consulapi.AgentServiceCheck {
+	labels := app.Labels
+	for _, check := range app.HealthChecks {
+		if !isHealthCheckAllowed(check.Protocol, config) {
+			continue
+		}
+		if check.Protocol == "COMMAND" && (config.CheckShell == "" || check.Command == nil) {
+			continue
+		}
+		var taskPort int
+		if check.PortIndex >= 0 && check.PortIndex < len(task.Ports) {
+			taskPort = task.Ports[check.PortIndex]
+		} else if check.Protocol != "COMMAND" {
+			metrics.Mark("consul.register.bad_port_index")
+			log.WithFields(log.Fields{
+				"Id": task.ID, "PortIndex": check.PortIndex, "Ports": task.Ports,
+			}).Warn("Health check port index out of task ports range, skipping check")
+			continue
+		}
+		port, path := proxyHealthEndpoint(labels, config, taskPort, check.Path)
+		target := net.JoinHostPort(checkHost(task.Host, labels, config), strconv.Itoa(port))
+		consulCheck := &consulapi.AgentServiceCheck{
+			Name:                  checkName(task, check.Protocol, labels, config),
+			Interval:              fmt.Sprintf("%ds", check.IntervalSeconds),
+			Timeout:               checkTimeout(check, config),
+			FailuresBeforeWarning: config.CheckFailuresBeforeWarning,
+			Status:                config.CheckInitialStatus,
+		}
+		if config.DeregisterCriticalServiceAfter > 0 {
+			consulCheck.DeregisterCriticalServiceAfter = config.DeregisterCriticalServiceAfter.String()
+		}
+		switch check.Protocol {
+		case "HTTP", "HTTPS":
+			path, err := expandTaskTemplate(path, task, app)
+			if err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"Id": task.ID, "Path": check.Path,
+				}).Warn("Invalid health check path template, skipping check")
+				continue
 			}
+			consulCheck.Method = checkMethod(task, labels, config)
+			consulCheck.HTTP = (&url.URL{
+				Scheme: strings.ToLower(check.Protocol),
+				Host:   target,
+				Path:   path,
+			}).String()
+			consulCheck.Header = checkHeaders(labels, config)
+			if check.Protocol == "HTTPS" {
+				consulCheck.TLSSkipVerify = checkTLSSkipVerify(labels, config)
+			}
+		case "TCP":
+			consulCheck.TCP = target
+		case "COMMAND":
+			consulCheck.Args = []string{config.CheckShell, "-c", check.Command.Value}
+		}
+		if isShortLived(labels, config) {
+			consulCheck.Interval = config.ShortLivedCheckInterval.String()
+			consulCheck.DeregisterCriticalServiceAfter = config.ShortLivedDeregisterAfter.String()
 		}
+		return consulCheck
 	}
 	return nil
 }
 
-// Extract labels keys with value tag and return as slice
+// App is managed when label named as the label prefix is set to true
+func isManagedApp(labels map[string]string, config *ConsulConfig) bool {
+	return labels[config.label("")] == "true"
+}
+
+// Services of short-lived (batch, cron) tasks are checked often and removed by Consul
+// soon after they turn critical, so they do not linger when deregistration is missed
+func isShortLived(labels map[string]string, config *ConsulConfig) bool {
+	return labels[config.label("shortLived")] == "true"
+}
+
+// Descriptive check name shown in Consul UI and alerts, check.name label overrides it
+func checkName(task tasks.Task, protocol string, labels map[string]string, config *ConsulConfig) string {
+	if name := labels[config.label("check.name")]; name != "" {
+		return name
+	}
+	return fmt.Sprintf("%s %s check", appIdToServiceName(task.AppID, config.ServiceNameSegments), protocol)
+}
+
+// Checks of endpoints bound to loopback interface target agent localhost
+func checkHost(host string, labels map[string]string, config *ConsulConfig) string {
+	if labels[config.label("check.localhost")] == "true" {
+		return "127.0.0.1"
+	}
+	return host
+}
+
+// Marathon check timeout unless it is overridden for check protocol
+func checkTimeout(check apps.HealthCheck, config *ConsulConfig) string {
+	if timeout, ok := config.CheckTimeoutByProtocol[check.Protocol]; ok {
+		return timeout.String()
+	}
+	return fmt.Sprintf("%ds", check.TimeoutSeconds)
+}
+
+var httpMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace,
+}
+
+// HTTP check method from check.method label, empty (Consul default GET) without it.
+// Registration rejects labels other than HTTP verbs, conversion alone falls back to GET for them.
+func checkMethod(task tasks.Task, labels map[string]string, config *ConsulConfig) string {
+	method, ok := labels[config.label("check.method")]
+	if !ok {
+		return ""
+	}
+	method = strings.ToUpper(method)
+	if !contains(httpMethods, method) {
+		log.WithFields(log.Fields{
+			"Id": task.ID, "Method": method,
+		}).Warn("Invalid health check method, using GET")
+		return ""
+	}
+	return method
+}
+
+// HTTP check headers from check.header.<name> labels, nil without such labels
+func checkHeaders(labels map[string]string, config *ConsulConfig) map[string][]string {
+	prefix := config.label("check.header.")
+	var headers map[string][]string
+	for key, value := range labels {
+		if !strings.HasPrefix(key, prefix) || len(key) == len(prefix) {
+			continue
+		}
+		if headers == nil {
+			headers = make(map[string][]string)
+		}
+		name := http.CanonicalHeaderKey(strings.TrimPrefix(key, prefix))
+		headers[name] = append(headers[name], value)
+	}
+	return headers
+}
+
+// Label decides whether HTTPS check certificate is verified, global setting applies without it
+func checkTLSSkipVerify(labels map[string]string, config *ConsulConfig) bool {
+	value, ok := labels[config.label("check.tlsSkipVerify")]
+	if !ok {
+		return config.CheckTLSSkipVerify
+	}
+	skip, err := strconv.ParseBool(value)
+	if err != nil {
+		log.WithError(err).WithField("Value", value).Warn("Invalid check TLS skip verify label, using global setting")
+		return config.CheckTLSSkipVerify
+	}
+	return skip
+}
+
+func isHealthCheckAllowed(protocol string, config *ConsulConfig) bool {
+	if !contains(SupportedHealthChecks, protocol) {
+		return false
+	}
+	if len(config.AllowedHealthChecks) == 0 {
+		return contains(DefaultHealthChecks, protocol)
+	}
+	return contains(config.AllowedHealthChecks, protocol)
+}
+
+// Data of task templates, task fields are available directly and its app as .App
+type taskTemplateData struct {
+	tasks.Task
+	App *apps.App
+}
+
+// App seen by templates, app with ID only when it is not known
+func templateApp(task tasks.Task, app *apps.App) *apps.App {
+	if app == nil {
+		return &apps.App{ID: task.AppID}
+	}
+	return app
+}
+
+// Expands text as a template of task and app fields e.g. /health/{{.ID}} or v{{.App.Version}}
+func expandTaskTemplate(text string, task tasks.Task, app *apps.App) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tmpl, err := template.New("").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var expanded bytes.Buffer
+	if err := tmpl.Execute(&expanded, taskTemplateData{Task: task, App: templateApp(task, app)}); err != nil {
+		return "", err
+	}
+	return expanded.String(), nil
+}
+
+// Points the check at the sidecar proxy health endpoint when it is defined in labels
+func proxyHealthEndpoint(labels map[string]string, config *ConsulConfig, port int, path string) (int, string) {
+	value, ok := labels[config.label("check.proxyHealthPort")]
+	if !ok {
+		return port, path
+	}
+	proxyPort, err := strconv.Atoi(value)
+	if err != nil {
+		log.WithError(err).WithField("Port", value).Warn("Invalid proxy health port, using service port")
+		return port, path
+	}
+	if proxyPath, ok := labels[config.label("check.proxyHealthPath")]; ok {
+		path = proxyPath
+	}
+	return proxyPort, path
+}
+
+// Adds configured default tag to apps that do not define any tags
+// Tags that are templates of task fields (e.g. version-{{.Version}}) are expanded, invalid ones are skipped
+func serviceTags(task tasks.Task, app *apps.App, config *ConsulConfig) []string {
+	var tags []string
+	for _, tag := range marathonLabelsToConsulTags(app.Labels) {
+		expanded, err := expandTaskTemplate(tag, task, app)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"Id": task.ID, "Tag": tag,
+			}).Warn("Invalid tag template, skipping tag")
+			continue
+		}
+		tags = append(tags, expanded)
+	}
+	if len(tags) == 1 && config.DefaultTagWhenNone != "" {
+		tags = append(tags, config.DefaultTagWhenNone)
+	}
+	return tags
+}
+
+// Structured service metadata, task ID and values of configured labels
+// (keys with characters Consul does not accept replaced with underscore)
+func serviceMeta(task tasks.Task, labels map[string]string, config *ConsulConfig) map[string]string {
+	meta := make(map[string]string)
+	for _, label := range config.MetaFromLabels {
+		if value, ok := labels[label]; ok {
+			meta[invalidMetaKeyChars.ReplaceAllString(label, "_")] = value
+		}
+	}
+	// reserved keys are written last so labels can not overwrite them
+	meta[TaskIdMetaKey] = task.ID
+	meta[AppIdMetaKey] = task.AppID
+	return meta
+}
+
+// Extract labels keys with value tag and return as slice.
+// Keys are sorted so tags do not depend on map iteration order
+// and restarts do not re-register unchanged services.
 func marathonLabelsToConsulTags(labels map[string]string) []string {
-	tags := []string{"marathon"}
+	var keys []string
 	for key, value := range labels {
 		if value == "tag" {
-			tags = append(tags, key)
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return append([]string{"marathon"}, keys...)
+}
+
+// Turns app constraints on configured fields into tags of constraint parts
+// joined with colons, e.g. rack_id:CLUSTER:rack-1
+func constraintTags(constraints [][]string, config *ConsulConfig) []string {
+	var tags []string
+	for _, constraint := range constraints {
+		if len(constraint) < 2 || !contains(config.TagFromConstraints, constraint[0]) {
+			continue
 		}
+		tags = append(tags, strings.Join(constraint, ":"))
 	}
 	return tags
 }
 
-func appIdToServiceName(appId string) (serviceId string) {
-	serviceId = strings.Replace(strings.Trim(appId, "/"), "/", ".", -1)
+// Joins app ID path segments with dots keeping only given number of last segments (all when 0)
+func appIdToServiceName(appId string, segments int) (serviceId string) {
+	parts := strings.Split(strings.Trim(appId, "/"), "/")
+	if segments > 0 && segments < len(parts) {
+		parts = parts[len(parts)-segments:]
+	}
+	serviceId = strings.Join(parts, ".")
 	return serviceId
 }
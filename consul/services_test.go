@@ -3,8 +3,11 @@ package consul
 import (
 	"github.com/allegro/marathon-consul/apps"
 	"github.com/allegro/marathon-consul/tasks"
+	consulapi "github.com/hashicorp/consul/api"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestMarathonTaskToConsulServiceMapping(t *testing.T) {
@@ -42,3 +45,975 @@ func TestMarathonTaskToConsulServiceMapping(t *testing.T) {
 	assert.Equal(t, "http://127.0.0.6:8090/api/health", service.Check.HTTP)
 	assert.Equal(t, "60s", service.Check.Interval)
 }
+
+func TestMarathonTaskToConsulServiceWithProxyHealthEndpoint(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8090, 8443},
+	}
+	labels := map[string]string{
+		"consul":                       "true",
+		"consul.check.proxyHealthPort": "9901",
+		"consul.check.proxyHealthPath": "/ready",
+	}
+	healthChecks := []apps.HealthCheck{
+		apps.HealthCheck{
+			Path:            "/api/health",
+			Protocol:        "HTTP",
+			PortIndex:       0,
+			IntervalSeconds: 60,
+		},
+	}
+
+	// when
+	service := MarathonTaskToConsulService(task, healthChecks, labels)
+
+	// then
+	assert.Equal(t, 8090, service.Port)
+	assert.Equal(t, "http://127.0.0.6:9901/ready", service.Check.HTTP)
+}
+
+func TestMarathonTaskToConsulServiceWithInvalidProxyHealthPort(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8090},
+	}
+	labels := map[string]string{
+		"consul":                       "true",
+		"consul.check.proxyHealthPort": "admin",
+	}
+	healthChecks := []apps.HealthCheck{
+		apps.HealthCheck{
+			Path:     "/api/health",
+			Protocol: "HTTP",
+		},
+	}
+
+	// when
+	service := MarathonTaskToConsulService(task, healthChecks, labels)
+
+	// then
+	assert.Equal(t, "http://127.0.0.6:8090/api/health", service.Check.HTTP)
+}
+
+func TestServiceIdKeepsValidTaskIds(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "app_1.4d3c62c6-9b0a-11e5-8f4a-0242ac110002", ServiceId("app_1.4d3c62c6-9b0a-11e5-8f4a-0242ac110002"))
+}
+
+func TestServiceIdSanitizesInvalidCharacters(t *testing.T) {
+	t.Parallel()
+
+	// when
+	first := ServiceId("group/app:1 task")
+	second := ServiceId("group_app:1 task")
+
+	// then
+	assert.Regexp(t, `^group-app-1-task-[0-9a-f]{8}$`, first)
+	assert.Equal(t, first, ServiceId("group/app:1 task"))
+	assert.NotEqual(t, first, second)
+}
+
+func TestServiceIdLimitsLength(t *testing.T) {
+	t.Parallel()
+
+	// given
+	taskId := strings.Repeat("a", 200)
+
+	// when
+	serviceId := ServiceId(taskId)
+
+	// then
+	assert.Len(t, serviceId, maxServiceIdLength)
+	assert.NotEqual(t, serviceId, ServiceId(strings.Repeat("a", 201)))
+}
+
+func TestMarathonTaskToConsulServiceTranslatesHttpsAndTcpChecks(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8090, 8443},
+	}
+	httpsCheck := []apps.HealthCheck{{Path: "/health", Protocol: "HTTPS", PortIndex: 1}}
+	tcpCheck := []apps.HealthCheck{{Protocol: "TCP", PortIndex: 0}}
+
+	// when
+	httpsService := marathonTaskToConsulService(task, httpsCheck, nil, &ConsulConfig{AllowedHealthChecks: SupportedHealthChecks})
+	tcpService := marathonTaskToConsulService(task, tcpCheck, nil, &ConsulConfig{AllowedHealthChecks: SupportedHealthChecks})
+
+	// then
+	assert.Equal(t, "https://127.0.0.6:8443/health", httpsService.Check.HTTP)
+	assert.Equal(t, "127.0.0.6:8090", tcpService.Check.TCP)
+	assert.Empty(t, tcpService.Check.HTTP)
+}
+
+func TestMarathonTaskToConsulServiceWithAllowedHealthChecks(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8090},
+	}
+	healthChecks := []apps.HealthCheck{
+		{Path: "/health", Protocol: "HTTP"},
+		{Protocol: "COMMAND"},
+		{Protocol: "TCP"},
+	}
+	config := &ConsulConfig{AllowedHealthChecks: []string{"TCP"}}
+
+	// when
+	service := marathonTaskToConsulService(task, healthChecks, nil, config)
+
+	// then
+	assert.Empty(t, service.Check.HTTP)
+	assert.Equal(t, "127.0.0.6:8090", service.Check.TCP)
+}
+
+func TestMarathonTaskToConsulServiceTranslatesOnlyHttpChecksByDefault(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8090},
+	}
+	mixedChecks := []apps.HealthCheck{
+		{Protocol: "TCP"},
+		{Path: "/health", Protocol: "HTTP"},
+	}
+	httpsCheck := []apps.HealthCheck{{Path: "/health", Protocol: "HTTPS"}}
+
+	// when
+	mixed := marathonTaskToConsulService(task, mixedChecks, nil, &ConsulConfig{})
+	https := marathonTaskToConsulService(task, httpsCheck, nil, &ConsulConfig{})
+
+	// then
+	assert.Equal(t, "http://127.0.0.6:8090/health", mixed.Check.HTTP)
+	assert.Empty(t, mixed.Check.TCP)
+	assert.Nil(t, https.Check)
+}
+
+func TestMarathonTaskToConsulServiceWithoutAllowedHealthChecks(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8090},
+	}
+	healthChecks := []apps.HealthCheck{{Path: "/health", Protocol: "HTTP"}}
+	config := &ConsulConfig{AllowedHealthChecks: []string{"TCP"}}
+
+	// when
+	service := marathonTaskToConsulService(task, healthChecks, nil, config)
+
+	// then
+	assert.Nil(t, service.Check)
+}
+
+func TestMarathonTaskToConsulServiceWithCommandCheck(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8090},
+	}
+	healthChecks := []apps.HealthCheck{
+		{Protocol: "COMMAND", Command: &apps.Command{Value: "curl -f localhost:8090"}, IntervalSeconds: 30},
+	}
+
+	// when
+	withoutShell := marathonTaskToConsulService(task, healthChecks, nil, &ConsulConfig{AllowedHealthChecks: SupportedHealthChecks})
+	withShell := marathonTaskToConsulService(task, healthChecks, nil, &ConsulConfig{AllowedHealthChecks: SupportedHealthChecks, CheckShell: "/bin/sh"})
+
+	// then
+	assert.Nil(t, withoutShell.Check)
+	assert.Equal(t, []string{"/bin/sh", "-c", "curl -f localhost:8090"}, withShell.Check.Args)
+	assert.Equal(t, "30s", withShell.Check.Interval)
+}
+
+func TestMarathonTaskToConsulServiceWithAddressSelection(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8090},
+	}
+	healthChecks := []apps.HealthCheck{{Protocol: "TCP"}}
+	config := &ConsulConfig{AllowedHealthChecks: SupportedHealthChecks, AddressSelection: "first"}
+
+	// when
+	service := marathonTaskToConsulService(task, healthChecks, nil, config)
+
+	// then
+	assert.Equal(t, "127.0.0.6", service.Address)
+	assert.Equal(t, "127.0.0.6:8090", service.Check.TCP)
+}
+
+func TestMarathonTaskToConsulServiceIdFromTemplateIgnoresAddressSelection(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "app.1",
+		AppID: "app",
+		Host:  "localhost",
+		Ports: []int{8090},
+	}
+	config := &ConsulConfig{AddressSelection: "first", ServiceIdTemplate: "{{.TaskID}}-{{.Host}}"}
+
+	// when
+	service := marathonTaskToConsulService(task, nil, nil, config)
+
+	// then
+	assert.Equal(t, "app.1-localhost", service.ID)
+	assert.Equal(t, serviceId(task, config), service.ID)
+}
+
+func TestMarathonTaskToConsulServiceWithSocketPath(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+	}
+	labels := map[string]string{
+		"consul":            "true",
+		"consul.socketPath": "/var/run/app.sock",
+	}
+
+	// when
+	service := MarathonTaskToConsulService(task, nil, labels)
+
+	// then
+	assert.Equal(t, "/var/run/app.sock", service.SocketPath)
+	assert.Equal(t, 0, service.Port)
+}
+
+func TestMarathonTaskToConsulServiceReadsLabelsWithCustomPrefix(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8090},
+	}
+	labels := map[string]string{
+		"sd":                           "true",
+		"sd.check.proxyHealthPort":     "9901",
+		"consul.check.proxyHealthPort": "9902",
+	}
+	healthChecks := []apps.HealthCheck{
+		apps.HealthCheck{
+			Path:      "/api/health",
+			Protocol:  "HTTP",
+			PortIndex: 0,
+		},
+	}
+	config := &ConsulConfig{LabelPrefix: "sd"}
+
+	// when
+	service := marathonTaskToConsulService(task, healthChecks, labels, config)
+
+	// then
+	assert.True(t, isManagedApp(labels, config))
+	assert.Equal(t, "http://127.0.0.6:9901/api/health", service.Check.HTTP)
+}
+
+func TestIsManagedAppWithDefaultPrefix(t *testing.T) {
+	t.Parallel()
+
+	// given
+	config := &ConsulConfig{}
+
+	// then
+	assert.True(t, isManagedApp(map[string]string{"consul": "true"}, config))
+	assert.False(t, isManagedApp(map[string]string{"consul": "false"}, config))
+	assert.False(t, isManagedApp(map[string]string{"sd": "true"}, config))
+}
+
+func TestServiceTagsWithDefaultTagWhenNone(t *testing.T) {
+	t.Parallel()
+
+	// given
+	config := &ConsulConfig{DefaultTagWhenNone: "unlabeled"}
+
+	// when
+	withoutTags := serviceTags(tasks.Task{}, &apps.App{Labels: map[string]string{"consul": "true"}}, config)
+	withTags := serviceTags(tasks.Task{}, &apps.App{Labels: map[string]string{"consul": "true", "public": "tag"}}, config)
+
+	// then
+	assert.Equal(t, []string{"marathon", "unlabeled"}, withoutTags)
+	assert.Equal(t, []string{"marathon", "public"}, withTags)
+}
+
+func TestMarathonTaskToConsulServiceWithTemplatedCheckPath(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8090},
+	}
+	healthChecks := []apps.HealthCheck{
+		apps.HealthCheck{
+			Path:     "/health/{{.AppID}}/{{.ID}}",
+			Protocol: "HTTP",
+		},
+	}
+
+	// when
+	service := MarathonTaskToConsulService(task, healthChecks, nil)
+
+	// then
+	assert.Equal(t, "http://127.0.0.6:8090/health/someApp/someTask", service.Check.HTTP)
+}
+
+func TestMarathonTaskToConsulServiceSkipsCheckWithInvalidPathTemplate(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8090},
+	}
+	healthChecks := []apps.HealthCheck{
+		apps.HealthCheck{
+			Path:     "/health/{{.Unknown}}",
+			Protocol: "HTTP",
+		},
+		apps.HealthCheck{
+			Path:     "/health/{{.ID",
+			Protocol: "HTTP",
+		},
+		apps.HealthCheck{
+			Protocol: "TCP",
+		},
+	}
+
+	// when
+	service := marathonTaskToConsulService(task, healthChecks, nil, &ConsulConfig{AllowedHealthChecks: SupportedHealthChecks})
+
+	// then
+	assert.Empty(t, service.Check.HTTP)
+	assert.Equal(t, "127.0.0.6:8090", service.Check.TCP)
+}
+
+func TestServiceKindFromLabel(t *testing.T) {
+	t.Parallel()
+
+	// given
+	config := &ConsulConfig{}
+
+	// then
+	assert.Equal(t, consulapi.ServiceKindTypical, serviceKind(map[string]string{}, config))
+	assert.Equal(t, consulapi.ServiceKindMeshGateway, serviceKind(map[string]string{"consul.serviceKind": "mesh-gateway"}, config))
+	assert.Equal(t, consulapi.ServiceKindTypical, serviceKind(map[string]string{"consul.serviceKind": "gateway"}, config))
+}
+
+func TestAppIdToServiceNameWithSegments(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "team.sub.service", appIdToServiceName("/team/sub/service", 0))
+	assert.Equal(t, "service", appIdToServiceName("/team/sub/service", 1))
+	assert.Equal(t, "sub.service", appIdToServiceName("/team/sub/service", 2))
+	assert.Equal(t, "team.sub.service", appIdToServiceName("/team/sub/service", 5))
+	assert.Equal(t, "service", appIdToServiceName("/service", 1))
+}
+
+func TestMarathonTaskToConsulServiceWithLocalhostCheck(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "10.0.0.6",
+		Ports: []int{8090},
+	}
+	labels := map[string]string{
+		"consul":                 "true",
+		"consul.check.localhost": "true",
+	}
+	healthChecks := []apps.HealthCheck{
+		apps.HealthCheck{
+			Path:     "/api/health",
+			Protocol: "HTTP",
+		},
+	}
+
+	// when
+	service := MarathonTaskToConsulService(task, healthChecks, labels)
+
+	// then
+	assert.Equal(t, "10.0.0.6", service.Address)
+	assert.Equal(t, "http://127.0.0.1:8090/api/health", service.Check.HTTP)
+}
+
+func TestMarathonTaskToConsulServiceSkipsCheckWithOutOfRangePortIndex(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8090},
+	}
+	healthChecks := []apps.HealthCheck{
+		apps.HealthCheck{
+			Path:      "/api/health",
+			Protocol:  "HTTP",
+			PortIndex: 1,
+		},
+		apps.HealthCheck{
+			Protocol:  "TCP",
+			PortIndex: 0,
+		},
+	}
+
+	// when
+	service := marathonTaskToConsulService(task, healthChecks, nil, &ConsulConfig{AllowedHealthChecks: SupportedHealthChecks})
+
+	// then
+	assert.Empty(t, service.Check.HTTP)
+	assert.Equal(t, "127.0.0.6:8090", service.Check.TCP)
+}
+
+func TestMarathonTaskToConsulServiceWithOnlyOutOfRangePortIndex(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8090},
+	}
+	healthChecks := []apps.HealthCheck{
+		apps.HealthCheck{
+			Protocol:  "TCP",
+			PortIndex: 3,
+		},
+	}
+
+	// when
+	service := marathonTaskToConsulService(task, healthChecks, nil, &ConsulConfig{AllowedHealthChecks: SupportedHealthChecks})
+
+	// then
+	assert.Nil(t, service.Check)
+	assert.Equal(t, 8090, service.Port)
+}
+
+func TestMarathonTaskToConsulServiceWithFailuresBeforeWarning(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8090},
+	}
+	healthChecks := []apps.HealthCheck{
+		apps.HealthCheck{
+			Protocol: "TCP",
+		},
+	}
+
+	// when
+	withThreshold := marathonTaskToConsulService(task, healthChecks, nil, &ConsulConfig{AllowedHealthChecks: SupportedHealthChecks, CheckFailuresBeforeWarning: 2})
+	withoutThreshold := marathonTaskToConsulService(task, healthChecks, nil, &ConsulConfig{AllowedHealthChecks: SupportedHealthChecks})
+
+	// then
+	assert.Equal(t, 2, withThreshold.Check.FailuresBeforeWarning)
+	assert.Equal(t, 0, withoutThreshold.Check.FailuresBeforeWarning)
+}
+
+func TestMarathonTaskToConsulServiceForShortLivedTask(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8090},
+	}
+	healthChecks := []apps.HealthCheck{
+		apps.HealthCheck{
+			Protocol:        "TCP",
+			IntervalSeconds: 60,
+		},
+	}
+	config := &ConsulConfig{AllowedHealthChecks: SupportedHealthChecks, ShortLivedCheckInterval: 5 * time.Second, ShortLivedDeregisterAfter: time.Minute}
+
+	// when
+	shortLived := marathonTaskToConsulService(task, healthChecks, map[string]string{"consul.shortLived": "true"}, config)
+	longLived := marathonTaskToConsulService(task, healthChecks, map[string]string{}, config)
+
+	// then
+	assert.Equal(t, "5s", shortLived.Check.Interval)
+	assert.Equal(t, "1m0s", shortLived.Check.DeregisterCriticalServiceAfter)
+	assert.Equal(t, "60s", longLived.Check.Interval)
+	assert.Empty(t, longLived.Check.DeregisterCriticalServiceAfter)
+}
+
+func TestMarathonTaskToConsulServiceWithDeregisterCriticalServiceAfter(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8090},
+	}
+	healthChecks := []apps.HealthCheck{
+		apps.HealthCheck{
+			Protocol: "TCP",
+		},
+	}
+	config := &ConsulConfig{AllowedHealthChecks: SupportedHealthChecks, DeregisterCriticalServiceAfter: 90 * time.Minute, ShortLivedDeregisterAfter: time.Minute}
+
+	// when
+	withDeregister := marathonTaskToConsulService(task, healthChecks, nil, config)
+	withoutDeregister := marathonTaskToConsulService(task, healthChecks, nil, &ConsulConfig{AllowedHealthChecks: SupportedHealthChecks})
+	shortLived := marathonTaskToConsulService(task, healthChecks, map[string]string{"consul.shortLived": "true"}, config)
+
+	// then
+	assert.Equal(t, "1h30m0s", withDeregister.Check.DeregisterCriticalServiceAfter)
+	assert.Empty(t, withoutDeregister.Check.DeregisterCriticalServiceAfter)
+	assert.Equal(t, "1m0s", shortLived.Check.DeregisterCriticalServiceAfter)
+}
+
+func TestMarathonTaskToConsulServiceCheckName(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "/group/someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8090},
+	}
+	healthChecks := []apps.HealthCheck{
+		apps.HealthCheck{
+			Protocol: "HTTP",
+			Path:     "/health",
+		},
+	}
+
+	// when
+	defaultName := marathonTaskToConsulService(task, healthChecks, nil, &ConsulConfig{})
+	labeledName := marathonTaskToConsulService(task, healthChecks, map[string]string{"consul.check.name": "Some app readiness"}, &ConsulConfig{})
+
+	// then
+	assert.Equal(t, "group.someApp HTTP check", defaultName.Check.Name)
+	assert.Equal(t, "Some app readiness", labeledName.Check.Name)
+}
+
+func TestServiceIdFromTemplate(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{ID: "someTask", AppID: "/group/someApp", Host: "127.0.0.6", Ports: []int{8090}}
+
+	// then
+	assert.Equal(t, "someTask", serviceId(task, &ConsulConfig{}))
+	assert.Equal(t, "group.someApp_someTask_8090", serviceId(task, &ConsulConfig{ServiceIdTemplate: "{{.Name}}_{{.TaskID}}_{{.Port}}"}))
+	assert.Equal(t, ServiceId("/group/someApp:someTask"), serviceId(task, &ConsulConfig{ServiceIdTemplate: "{{.AppID}}:{{.TaskID}}"}))
+	assert.Equal(t, "someTask", serviceId(task, &ConsulConfig{ServiceIdTemplate: "{{.Missing}}"}))
+}
+
+func TestMarathonTaskToConsulServiceWithPublicAddress(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "10.1.2.3",
+		Ports: []int{8090},
+	}
+	healthChecks := []apps.HealthCheck{
+		apps.HealthCheck{
+			Protocol: "HTTP",
+			Path:     "/health",
+		},
+	}
+	labels := map[string]string{"consul.publicAddress": "203.0.113.7"}
+
+	// when
+	service := marathonTaskToConsulService(task, healthChecks, labels, &ConsulConfig{UseAgentAddress: true})
+
+	// then
+	assert.Equal(t, "203.0.113.7", service.Address)
+	assert.Equal(t, "http://10.1.2.3:8090/health", service.Check.HTTP)
+}
+
+func TestServiceMetaKeepsReservedKeys(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{ID: "someTask", AppID: "/someApp"}
+	labels := map[string]string{"marathon-task": "other", "marathon-app": "/other"}
+	config := &ConsulConfig{MetaFromLabels: []string{"marathon-task", "marathon-app"}}
+
+	// when
+	meta := serviceMeta(task, labels, config)
+
+	// then
+	assert.Equal(t, map[string]string{TaskIdMetaKey: "someTask", AppIdMetaKey: "/someApp"}, meta)
+}
+
+func TestServiceMeta(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{ID: "someTask", AppID: "/someApp"}
+	labels := map[string]string{"team.name": "platform", "owner": "ops", "public": "tag"}
+	config := &ConsulConfig{MetaFromLabels: []string{"team.name", "owner", "missing"}}
+
+	// when
+	meta := serviceMeta(task, labels, config)
+
+	// then
+	assert.Equal(t, map[string]string{
+		TaskIdMetaKey: "someTask",
+		AppIdMetaKey:  "/someApp",
+		"team_name":   "platform",
+		"owner":       "ops",
+	}, meta)
+	assert.Equal(t, map[string]string{TaskIdMetaKey: "someTask", AppIdMetaKey: "/someApp"}, serviceMeta(task, labels, &ConsulConfig{}))
+}
+
+func TestMarathonTaskToConsulServiceWithCheckHeaders(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8090},
+	}
+	healthChecks := []apps.HealthCheck{
+		apps.HealthCheck{
+			Protocol: "HTTP",
+			Path:     "/health",
+		},
+	}
+	labels := map[string]string{
+		"consul.check.header.host":          "app.example.com",
+		"consul.check.header.X-Health-Auth": "secret",
+	}
+
+	// when
+	withHeaders := marathonTaskToConsulService(task, healthChecks, labels, &ConsulConfig{})
+	withoutHeaders := marathonTaskToConsulService(task, healthChecks, nil, &ConsulConfig{})
+
+	// then
+	assert.Equal(t, map[string][]string{
+		"Host":          {"app.example.com"},
+		"X-Health-Auth": {"secret"},
+	}, withHeaders.Check.Header)
+	assert.Nil(t, withoutHeaders.Check.Header)
+}
+
+func TestMarathonTaskToConsulServiceWithCheckMethod(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8090},
+	}
+	healthChecks := []apps.HealthCheck{
+		apps.HealthCheck{
+			Protocol: "HTTP",
+			Path:     "/health",
+		},
+	}
+
+	// when
+	head := marathonTaskToConsulService(task, healthChecks, map[string]string{"consul.check.method": "head"}, &ConsulConfig{})
+	invalid := marathonTaskToConsulService(task, healthChecks, map[string]string{"consul.check.method": "FETCH"}, &ConsulConfig{})
+	withoutMethod := marathonTaskToConsulService(task, healthChecks, nil, &ConsulConfig{})
+
+	// then
+	assert.Equal(t, "HEAD", head.Check.Method)
+	assert.Equal(t, "http://127.0.0.6:8090/health", invalid.Check.HTTP)
+	assert.Equal(t, "", invalid.Check.Method)
+	assert.Equal(t, "", withoutMethod.Check.Method)
+}
+
+func TestAppTaskToConsulServiceTemplatesSeeAppFields(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.6", Ports: []int{8090}, Version: "task-version"}
+	app := &apps.App{
+		ID:           "/app",
+		Version:      "2016-01-01",
+		Labels:       map[string]string{"team": "platform", "v{{.App.Version}}": "tag", "{{.Version}}": "tag"},
+		HealthChecks: []apps.HealthCheck{{Protocol: "HTTP", Path: `/health/{{index .App.Labels "team"}}`}},
+	}
+	config := &ConsulConfig{ServiceIdTemplate: "{{.TaskID}}_{{.Task.Version}}"}
+
+	// when
+	service := appTaskToConsulService(task, app, config)
+
+	// then
+	assert.Equal(t, "app.1_task-version", service.ID)
+	assert.Equal(t, []string{"marathon", "v2016-01-01", "task-version"}, service.Tags)
+	assert.Equal(t, "http://127.0.0.6:8090/health/platform", service.Check.HTTP)
+}
+
+func TestServiceIdTemplateDoesNotSeeAppFields(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.6", Ports: []int{8090}}
+	app := &apps.App{ID: "/app", Version: "2016-01-01"}
+	config := &ConsulConfig{ServiceIdTemplate: "{{.TaskID}}_{{.App.Version}}"}
+
+	// when
+	service := appTaskToConsulService(task, app, config)
+
+	// then
+	assert.Equal(t, "app.1", service.ID)
+	_, err := expandServiceIdTemplate(config.ServiceIdTemplate, task, config)
+	assert.Error(t, err)
+}
+
+func TestMarathonTaskToConsulServiceWithCheckInitialStatus(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8090},
+	}
+	healthChecks := []apps.HealthCheck{
+		apps.HealthCheck{
+			Protocol: "TCP",
+		},
+	}
+
+	// when
+	critical := marathonTaskToConsulService(task, healthChecks, nil, &ConsulConfig{AllowedHealthChecks: SupportedHealthChecks, CheckInitialStatus: consulapi.HealthCritical})
+	consulDefault := marathonTaskToConsulService(task, healthChecks, nil, &ConsulConfig{AllowedHealthChecks: SupportedHealthChecks})
+
+	// then
+	assert.Equal(t, consulapi.HealthCritical, critical.Check.Status)
+	assert.Empty(t, consulDefault.Check.Status)
+}
+
+func TestMarathonTaskToConsulServiceWithUseAgentAddress(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8090},
+	}
+	healthChecks := []apps.HealthCheck{
+		apps.HealthCheck{
+			Protocol: "TCP",
+		},
+	}
+
+	// when
+	service := marathonTaskToConsulService(task, healthChecks, nil, &ConsulConfig{AllowedHealthChecks: SupportedHealthChecks, UseAgentAddress: true})
+
+	// then
+	assert.Empty(t, service.Address)
+	assert.Equal(t, "127.0.0.6:8090", service.Check.TCP)
+}
+
+func TestMarathonTaskToConsulServiceBracketsIPv6CheckTargets(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "2001:db8::6",
+		Ports: []int{8090},
+	}
+	httpCheck := []apps.HealthCheck{apps.HealthCheck{Protocol: "HTTPS", Path: "/health"}}
+	tcpCheck := []apps.HealthCheck{apps.HealthCheck{Protocol: "TCP"}}
+
+	// when
+	httpService := marathonTaskToConsulService(task, httpCheck, nil, &ConsulConfig{AllowedHealthChecks: SupportedHealthChecks})
+	tcpService := marathonTaskToConsulService(task, tcpCheck, nil, &ConsulConfig{AllowedHealthChecks: SupportedHealthChecks})
+
+	// then
+	assert.Equal(t, "https://[2001:db8::6]:8090/health", httpService.Check.HTTP)
+	assert.Equal(t, "[2001:db8::6]:8090", tcpService.Check.TCP)
+}
+
+func TestMarathonTaskToConsulServiceWithCheckTimeoutByProtocol(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8090},
+	}
+	config := &ConsulConfig{AllowedHealthChecks: SupportedHealthChecks, CheckTimeoutByProtocol: map[string]time.Duration{"TCP": 1500 * time.Millisecond}}
+	tcpCheck := []apps.HealthCheck{apps.HealthCheck{Protocol: "TCP", TimeoutSeconds: 20}}
+	httpCheck := []apps.HealthCheck{apps.HealthCheck{Protocol: "HTTP", TimeoutSeconds: 20}}
+
+	// when
+	tcpService := marathonTaskToConsulService(task, tcpCheck, nil, config)
+	httpService := marathonTaskToConsulService(task, httpCheck, nil, config)
+
+	// then
+	assert.Equal(t, "1.5s", tcpService.Check.Timeout)
+	assert.Equal(t, "20s", httpService.Check.Timeout)
+}
+
+func TestServiceTagsWithTemplates(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{ID: "someTask", Version: "2016-03-01T10:00:00.000Z"}
+	labels := map[string]string{
+		"consul":               "true",
+		"version-{{.Version}}": "tag",
+		"broken-{{.Version":    "tag",
+	}
+
+	// when
+	tags := serviceTags(task, &apps.App{Labels: labels}, &ConsulConfig{})
+
+	// then
+	assert.Equal(t, []string{"marathon", "version-2016-03-01T10:00:00.000Z"}, tags)
+}
+
+func TestServiceTagsDoNotDependOnLabelsOrder(t *testing.T) {
+	t.Parallel()
+
+	// given
+	keys := []string{"public", "canary", "zone-a", "backend", "v2"}
+
+	for i := range keys {
+		// labels inserted in different order on every iteration
+		labels := map[string]string{"consul": "true"}
+		for j := range keys {
+			labels[keys[(i+j)%len(keys)]] = "tag"
+		}
+
+		// when
+		tags := serviceTags(tasks.Task{}, &apps.App{Labels: labels}, &ConsulConfig{})
+
+		// then
+		assert.Equal(t, []string{"marathon", "backend", "canary", "public", "v2", "zone-a"}, tags)
+	}
+}
+
+func TestConstraintTags(t *testing.T) {
+	t.Parallel()
+
+	// given
+	constraints := [][]string{
+		{"rack_id", "CLUSTER", "rack-1"},
+		{"hostname", "UNIQUE"},
+		{"zone", "GROUP_BY", "3"},
+		{"rack_id"},
+	}
+	config := &ConsulConfig{TagFromConstraints: []string{"rack_id", "hostname"}}
+
+	// when
+	tags := constraintTags(constraints, config)
+
+	// then
+	assert.Equal(t, []string{"rack_id:CLUSTER:rack-1", "hostname:UNIQUE"}, tags)
+	assert.Empty(t, constraintTags(constraints, &ConsulConfig{}))
+}
+
+func TestMarathonTaskToConsulServiceWithPartition(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8090},
+	}
+	config := &ConsulConfig{Partition: "platform"}
+
+	// when
+	defaultPartition := marathonTaskToConsulService(task, nil, nil, config)
+	labelPartition := marathonTaskToConsulService(task, nil, map[string]string{"consul.partition": "payments"}, config)
+
+	// then
+	assert.Equal(t, "platform", defaultPartition.Partition)
+	assert.Equal(t, "payments", labelPartition.Partition)
+}
+
+func TestMarathonTaskToConsulServiceWithCheckTLSSkipVerify(t *testing.T) {
+	t.Parallel()
+
+	// given
+	task := tasks.Task{
+		ID:    "someTask",
+		AppID: "someApp",
+		Host:  "127.0.0.6",
+		Ports: []int{8443},
+	}
+	healthChecks := []apps.HealthCheck{apps.HealthCheck{Protocol: "HTTPS", Path: "/health"}}
+	skip := map[string]string{"consul.check.tlsSkipVerify": "true"}
+	verify := map[string]string{"consul.check.tlsSkipVerify": "false"}
+
+	// then
+	assert.False(t, marathonTaskToConsulService(task, healthChecks, nil, &ConsulConfig{AllowedHealthChecks: SupportedHealthChecks}).Check.TLSSkipVerify)
+	assert.True(t, marathonTaskToConsulService(task, healthChecks, nil, &ConsulConfig{AllowedHealthChecks: SupportedHealthChecks, CheckTLSSkipVerify: true}).Check.TLSSkipVerify)
+	assert.True(t, marathonTaskToConsulService(task, healthChecks, skip, &ConsulConfig{AllowedHealthChecks: SupportedHealthChecks}).Check.TLSSkipVerify)
+	assert.False(t, marathonTaskToConsulService(task, healthChecks, verify, &ConsulConfig{AllowedHealthChecks: SupportedHealthChecks, CheckTLSSkipVerify: true}).Check.TLSSkipVerify)
+}
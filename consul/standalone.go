@@ -0,0 +1,84 @@
+package consul
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/allegro/marathon-consul/apps"
+	"github.com/allegro/marathon-consul/metrics"
+	"github.com/allegro/marathon-consul/tasks"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+const standaloneCheckInterval = "10s"
+
+func standaloneCheckId(serviceId string) string {
+	return "standalone:" + serviceId
+}
+
+// Registers HTTP check from standaloneCheck label (URL, may use task templates) separately from
+// the service, it is associated with the service but has its own lifecycle in agent.
+// Check is registered again only when its URL changes.
+func (c *Consul) registerStandaloneCheck(task tasks.Task, app *apps.App, service *consulapi.AgentServiceRegistration) error {
+	value := app.Labels[c.config.label("standaloneCheck")]
+	if value == "" {
+		return nil
+	}
+	url, err := expandTaskTemplate(value, task, app)
+	if err != nil {
+		log.WithError(err).WithField("Id", service.ID).Warn("Invalid standalone check template, skipping check")
+		return nil
+	}
+	if c.standaloneCheckUrl(service.ID) == url {
+		return nil
+	}
+	return c.registerStandaloneCheckUrl(service, url)
+}
+
+func (c *Consul) registerStandaloneCheckUrl(service *consulapi.AgentServiceRegistration, url string) error {
+	agentAddress, _ := c.registrations.agent(service.ID)
+	agent, err := c.agents.GetAgent(agentAddress)
+	if err != nil {
+		return err
+	}
+	err = agent.Agent().CheckRegister(&consulapi.AgentCheckRegistration{
+		ID:        standaloneCheckId(service.ID),
+		Name:      service.Name + " standalone check",
+		ServiceID: service.ID,
+		AgentServiceCheck: consulapi.AgentServiceCheck{
+			HTTP:     url,
+			Interval: standaloneCheckInterval,
+		},
+	})
+	if err != nil {
+		metrics.Mark("consul.standalone_check.register.error")
+		return err
+	}
+	c.lock.Lock()
+	c.standaloneChecks[service.ID] = url
+	c.lock.Unlock()
+	return nil
+}
+
+// Lock guards only the checks map, agent calls are made without holding it
+func (c *Consul) standaloneCheckUrl(serviceId string) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.standaloneChecks[serviceId]
+}
+
+// Removes standalone check before its service, so it does not depend on agent
+// removing checks together with their services
+func (c *Consul) deregisterStandaloneCheck(serviceId string, agent *consulapi.Client) {
+	if c.standaloneCheckUrl(serviceId) == "" {
+		return
+	}
+	if err := agent.Agent().CheckDeregister(standaloneCheckId(serviceId)); err != nil {
+		log.WithError(err).WithField("Id", serviceId).Warn("Unable to deregister standalone check")
+	}
+	c.forgetStandaloneCheck(serviceId)
+}
+
+func (c *Consul) forgetStandaloneCheck(serviceId string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.standaloneChecks, serviceId)
+}
@@ -0,0 +1,64 @@
+package consul
+
+import (
+	"github.com/allegro/marathon-consul/apps"
+	"github.com/allegro/marathon-consul/tasks"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestStandaloneCheckIsRegisteredAndCleanedUp(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	agent, _ := consul.agents.GetAgent("127.0.0.1")
+
+	// given
+	app := &apps.App{ID: "/app", Labels: map[string]string{
+		"consul":                 "true",
+		"consul.standaloneCheck": "http://{{.Host}}:9090/ready",
+	}}
+	task := tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.1", Ports: []int{8080}}
+
+	// when
+	_, err := consul.RegisterTask(task, app)
+
+	// then
+	assert.NoError(t, err)
+	checks, _ := agent.Agent().Checks()
+	assert.Contains(t, checks, "standalone:app.1")
+	assert.Equal(t, "app.1", checks["standalone:app.1"].ServiceID)
+	assert.Equal(t, "http://127.0.0.1:9090/ready", consul.standaloneChecks["app.1"])
+
+	// when
+	_, err = consul.Deregister("app.1", "127.0.0.1")
+
+	// then
+	assert.NoError(t, err)
+	checks, _ = agent.Agent().Checks()
+	assert.NotContains(t, checks, "standalone:app.1")
+	assert.Empty(t, consul.standaloneChecks)
+}
+
+func TestNoStandaloneCheckWithoutLabel(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+
+	// given
+	app := &apps.App{ID: "/app", Labels: map[string]string{"consul": "true"}}
+	task := tasks.Task{ID: "app.1", AppID: "/app", Host: "127.0.0.1", Ports: []int{8080}}
+
+	// when
+	_, err := consul.RegisterTask(task, app)
+
+	// then
+	assert.NoError(t, err)
+	agent, _ := consul.agents.GetAgent("127.0.0.1")
+	checks, _ := agent.Agent().Checks()
+	assert.NotContains(t, checks, "standalone:app.1")
+}
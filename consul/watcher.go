@@ -0,0 +1,85 @@
+package consul
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/allegro/marathon-consul/metrics"
+	consulapi "github.com/hashicorp/consul/api"
+	"time"
+)
+
+// Number of consecutive critical observations per service ID
+type criticalObservations map[string]int
+
+func (c *Consul) StartCriticalServicesWatcher(interval time.Duration) *time.Ticker {
+	log.WithFields(log.Fields{
+		"Interval":         interval,
+		"Observations":     c.config.DeregisterCriticalAfterObservations,
+		"WeightDecaySteps": c.config.WeightDecaySteps,
+	}).Info("Critical services watcher started")
+	ticker := time.NewTicker(interval)
+	go func() {
+		observations := make(criticalObservations)
+		failures := make(failingObservations)
+		for range ticker.C {
+			if c.config.DeregisterCriticalAfterObservations > 0 {
+				c.deregisterCriticalServices(observations)
+			}
+			if c.config.WeightDecaySteps > 0 {
+				c.decayWeights(failures)
+			}
+		}
+	}()
+	return ticker
+}
+
+// Deregisters services registered by this instance observed critical too many times in a row,
+// services of other instances and clusters are left untouched
+func (c *Consul) deregisterCriticalServices(observations criticalObservations) {
+	entries, err := c.getAllServiceEntries()
+	if err != nil {
+		log.WithError(err).Error("Can't get health of Consul services")
+		return
+	}
+
+	seen := make(map[string]struct{})
+	for _, entry := range entries {
+		serviceId := entry.Service.ID
+		agentAddress, ok := c.registrations.agent(serviceId)
+		if !ok {
+			continue
+		}
+		seen[serviceId] = struct{}{}
+		if entry.Checks.AggregatedStatus() != consulapi.HealthCritical {
+			delete(observations, serviceId)
+			continue
+		}
+		observations[serviceId]++
+		if observations[serviceId] < c.config.DeregisterCriticalAfterObservations {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"Id":           serviceId,
+			"Observations": observations[serviceId],
+		}).Info("Service observed critical too many times")
+		metrics.Mark("consul.deregister.critical")
+		if _, err := c.Deregister(serviceId, agentAddress); err != nil {
+			log.WithError(err).WithField("Id", serviceId).Error("Can't deregister critical service")
+			continue
+		}
+		delete(observations, serviceId)
+	}
+	for serviceId := range observations {
+		if _, ok := seen[serviceId]; !ok {
+			delete(observations, serviceId)
+		}
+	}
+}
+
+// Agent service was registered in, node address for services registered by another instance.
+// Service address is not used as it may be public address of service behind NAT.
+func (c *Consul) serviceAgentAddress(entry *consulapi.ServiceEntry) string {
+	if agentAddress, ok := c.registrations.agent(entry.Service.ID); ok {
+		return agentAddress
+	}
+	return entry.Node.Address
+}
@@ -0,0 +1,97 @@
+package consul
+
+import (
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func serviceWithStatus(id string, status string) *consulapi.AgentServiceRegistration {
+	return &consulapi.AgentServiceRegistration{
+		ID:      id,
+		Name:    id,
+		Address: "127.0.0.1",
+		Port:    8080,
+		Tags:    []string{"marathon"},
+		Check:   &consulapi.AgentServiceCheck{TTL: "10m", Status: status},
+	}
+}
+
+func TestDeregisterServicesObservedCriticalInARow(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	consul.config.DeregisterCriticalAfterObservations = 3
+
+	// given
+	consul.Register(serviceWithStatus("serviceA", "critical"))
+	consul.Register(serviceWithStatus("serviceB", "passing"))
+	observations := make(criticalObservations)
+
+	// when
+	consul.deregisterCriticalServices(observations)
+	consul.deregisterCriticalServices(observations)
+
+	// then
+	services, _ := consul.GetAllServices()
+	assert.Equal(t, 2, len(services))
+	assert.Equal(t, 2, observations["serviceA"])
+
+	// when
+	consul.deregisterCriticalServices(observations)
+
+	// then
+	services, _ = consul.GetAllServices()
+	assert.Equal(t, 1, len(services))
+	assert.Equal(t, "serviceB", services[0].ServiceName)
+	assert.Empty(t, observations)
+}
+
+func TestCriticalObservationsResetWhenServiceRecovers(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	consul.config.DeregisterCriticalAfterObservations = 3
+
+	// given
+	consul.Register(serviceWithStatus("serviceA", "critical"))
+	observations := make(criticalObservations)
+	consul.deregisterCriticalServices(observations)
+	consul.deregisterCriticalServices(observations)
+
+	// when
+	agent, _ := consul.agents.GetAgent("127.0.0.1")
+	agent.Agent().ServiceRegister(serviceWithStatus("serviceA", "passing"))
+	consul.deregisterCriticalServices(observations)
+	consul.deregisterCriticalServices(observations)
+
+	// then
+	services, _ := consul.GetAllServices()
+	assert.Equal(t, 1, len(services))
+	assert.Empty(t, observations)
+}
+
+func TestCriticalServicesOfOtherInstancesAreNotDeregistered(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	consul.config.DeregisterCriticalAfterObservations = 1
+
+	// given
+	server.AddService("serviceA", "critical", []string{"marathon"})
+	observations := make(criticalObservations)
+
+	// when
+	consul.deregisterCriticalServices(observations)
+
+	// then
+	services, _ := consul.GetAllServices()
+	assert.Equal(t, 1, len(services))
+	assert.Empty(t, observations)
+}
@@ -0,0 +1,65 @@
+package consul
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/allegro/marathon-consul/metrics"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Number of consecutive failing (warning or critical) observations per service ID
+type failingObservations map[string]int
+
+// Lowers weight of services registered by this instance proportionally to the number
+// of failing observations in a row, weight is restored when service passes again
+func (c *Consul) decayWeights(failures failingObservations) {
+	entries, err := c.getAllServiceEntries()
+	if err != nil {
+		log.WithError(err).Error("Can't get health of Consul services")
+		return
+	}
+
+	for _, entry := range entries {
+		serviceId := entry.Service.ID
+		service, ok := c.registrations.get(serviceId)
+		if !ok || service.Weights == nil {
+			continue
+		}
+		if entry.Checks.AggregatedStatus() == consulapi.HealthPassing {
+			if failures[serviceId] > 0 {
+				delete(failures, serviceId)
+				c.updateWeight(service, service.Weights.Passing)
+			}
+			continue
+		}
+		if failures[serviceId] >= c.config.WeightDecaySteps {
+			continue
+		}
+		failures[serviceId]++
+		steps := c.config.WeightDecaySteps
+		weight := service.Weights.Passing * (steps - failures[serviceId]) / steps
+		if weight < 1 {
+			weight = 1
+		}
+		metrics.Mark("consul.weight.decay")
+		c.updateWeight(service, weight)
+	}
+}
+
+// Registers service again with changed weight, cached registration keeps original weight
+func (c *Consul) updateWeight(service *consulapi.AgentServiceRegistration, weight int) {
+	agentAddress, _ := c.registrations.agent(service.ID)
+	agent, err := c.agents.GetAgent(agentAddress)
+	if err != nil {
+		log.WithError(err).WithField("Id", service.ID).Warn("Unable to get agent to update weight")
+		return
+	}
+	weighted := *service
+	weighted.Weights = &consulapi.AgentWeights{Passing: weight, Warning: weight}
+	log.WithFields(log.Fields{
+		"Id":     service.ID,
+		"Weight": weight,
+	}).Debug("Updating service weight")
+	if err := agent.Agent().ServiceRegister(&weighted); err != nil {
+		log.WithError(err).WithField("Id", service.ID).Warn("Unable to update service weight")
+	}
+}
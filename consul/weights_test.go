@@ -0,0 +1,59 @@
+package consul
+
+import (
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDecayWeightsOfFailingServices(t *testing.T) {
+	t.Parallel()
+	server := CreateConsulTestServer("dc1", t)
+	defer server.Stop()
+
+	consul := ConsulClientAtServer(server)
+	consul.config.WeightDecaySteps = 3
+
+	// given
+	consul.Register(&consulapi.AgentServiceRegistration{
+		ID:      "serviceA",
+		Name:    "serviceA",
+		Address: "127.0.0.1",
+		Port:    8080,
+		Tags:    []string{"marathon"},
+		Weights: serviceWeights(consul.config),
+	})
+	server.AddCheck("serviceA-check", "serviceA", "critical")
+	failures := make(failingObservations)
+	agent, _ := consul.agents.GetAgent("127.0.0.1")
+	weight := func() int {
+		services, _ := agent.Agent().Services()
+		return services["serviceA"].Weights.Passing
+	}
+
+	// then
+	assert.Equal(t, 4, weight())
+
+	// when
+	consul.decayWeights(failures)
+
+	// then
+	assert.Equal(t, 2, weight())
+
+	// when
+	consul.decayWeights(failures)
+	consul.decayWeights(failures)
+	consul.decayWeights(failures)
+
+	// then
+	assert.Equal(t, 1, weight())
+	assert.Equal(t, 3, failures["serviceA"])
+
+	// when
+	server.AddCheck("serviceA-check", "serviceA", "passing")
+	consul.decayWeights(failures)
+
+	// then
+	assert.Equal(t, 4, weight())
+	assert.Empty(t, failures)
+}
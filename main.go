@@ -8,6 +8,9 @@ import (
 	"github.com/allegro/marathon-consul/metrics"
 	"github.com/allegro/marathon-consul/sync"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 const Name = "marathon-consul"
@@ -28,11 +31,32 @@ func main() {
 	sync := sync.New(remote, service)
 	go sync.StartSyncServicesJob(config.Sync.Interval)
 
+	if config.Consul.DeregisterCriticalAfterObservations > 0 || config.Consul.WeightDecaySteps > 0 {
+		service.StartCriticalServicesWatcher(config.Consul.CriticalWatchInterval)
+	}
+
+	if config.Consul.RegistrationRefreshInterval > 0 {
+		service.StartRegistrationRefresher(config.Consul.RegistrationRefreshInterval)
+	}
+
+	go finishOnSignal(service)
+
 	// set up routes
 	http.HandleFunc("/health", HealthHandler)
+	http.HandleFunc("/config", ConfigHandler(config.Redacted()))
 	forwarderHandler := &ForwardHandler{service, remote}
 	http.HandleFunc("/events", forwarderHandler.Handle)
 
 	log.WithField("port", config.Web.Listen).Info("Listening")
 	log.Fatal(http.ListenAndServe(config.Web.Listen, nil))
 }
+
+// Services with weight being lowered are deregistered before exit, so they are not left at reduced weight
+func finishOnSignal(service *service.Consul) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	log.Info("Deregistering services with weight being lowered before exit")
+	service.FinishWeightRampDowns()
+	os.Exit(0)
+}
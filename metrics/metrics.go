@@ -30,6 +30,11 @@ func Mark(name string) {
 	meter.Mark(1)
 }
 
+func UpdateGauge(name string, value int64) {
+	gauge := metrics.GetOrRegisterGauge(name, metrics.DefaultRegistry)
+	gauge.Update(value)
+}
+
 func Time(name string, function func()) {
 	timer := metrics.GetOrRegisterTimer(name, metrics.DefaultRegistry)
 	timer.Time(function)
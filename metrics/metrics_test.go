@@ -4,6 +4,7 @@ import (
 	"net/url"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestDefaultPrefix(t *testing.T) {
@@ -37,3 +38,25 @@ func TestTargetName(t *testing.T) {
 		}
 	}
 }
+
+func TestMetricsDoNotBlockWhenGraphiteIsUnreachable(t *testing.T) {
+	// nothing listens on port 1, reporter fails on every flush
+	if err := initGraphite("127.0.0.1:1", 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			Mark("test.unreachable.mark")
+			Time("test.unreachable.time", func() {})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("metrics blocked while graphite is unreachable")
+	}
+}
@@ -10,6 +10,33 @@ import (
 	"time"
 )
 
+// Outcome of a single sync
+type syncSummary struct {
+	registered   int
+	unchanged    int
+	deregistered int
+	pending      int
+	skipped      int
+	failed       int
+}
+
+func (summary *syncSummary) report() {
+	metrics.UpdateGauge("sync.summary.registered", int64(summary.registered))
+	metrics.UpdateGauge("sync.summary.unchanged", int64(summary.unchanged))
+	metrics.UpdateGauge("sync.summary.deregistered", int64(summary.deregistered))
+	metrics.UpdateGauge("sync.summary.pending", int64(summary.pending))
+	metrics.UpdateGauge("sync.summary.skipped", int64(summary.skipped))
+	metrics.UpdateGauge("sync.summary.failed", int64(summary.failed))
+	log.WithFields(log.Fields{
+		"Registered":   summary.registered,
+		"Unchanged":    summary.unchanged,
+		"Deregistered": summary.deregistered,
+		"Pending":      summary.pending,
+		"Skipped":      summary.skipped,
+		"Failed":       summary.failed,
+	}).Info("Syncing services finished")
+}
+
 type Sync struct {
 	marathon marathon.Marathoner
 	service  service.ConsulServices
@@ -36,74 +63,95 @@ func (s *Sync) StartSyncServicesJob(interval time.Duration) *time.Ticker {
 
 func (s *Sync) SyncServices() error {
 	var err error
-	metrics.Time("sync.services", func() { err = s.syncServices() })
+	metrics.Time("sync.services", func() { _, err = s.syncServices() })
 	return err
 }
 
-func (s *Sync) syncServices() error {
+func (s *Sync) syncServices() (*syncSummary, error) {
 	log.Info("Syncing services")
 
 	apps, err := s.marathon.Apps()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	s.registerMarathonApps(apps)
+	liveServiceIds := s.liveServiceIds(apps)
+	s.service.PruneRegistrations(liveServiceIds)
+
+	summary := &syncSummary{}
+	s.registerMarathonApps(apps, summary)
 
 	services, err := s.service.GetAllServices()
 	if err != nil {
 		log.WithError(err).Error("Can't get all Consul services")
-		return err
+		return nil, err
 	}
 
-	s.deregisterConsulServicesThatAreNotInMarathonApps(apps, services)
+	s.deregisterConsulServicesThatAreNotInMarathonApps(liveServiceIds, services, summary)
 
-	log.Info("Syncing services finished")
-	return nil
+	summary.report()
+	return summary, nil
 }
 
-func (s *Sync) registerMarathonApps(apps []*apps.App) {
+func (s *Sync) registerMarathonApps(apps []*apps.App, summary *syncSummary) {
 
 	for _, app := range apps {
 		tasks := app.Tasks
-		healthCheck := app.HealthChecks
-		labels := app.Labels
 
-		if value, ok := app.Labels["consul"]; !ok || value != "true" {
+		if !s.service.IsManaged(app) {
 			log.WithField("APP", app.ID).Debug("App should not be registered in Consul")
 			continue
 		}
 
 		for _, task := range tasks {
 			if service.IsTaskHealthy(task.HealthCheckResults) {
-				service := service.MarathonTaskToConsulService(task, healthCheck, labels)
-				err := s.service.Register(service)
+				outcome, err := s.service.RegisterTask(task, app)
 				if err != nil {
+					summary.failed++
 					log.WithError(err).WithField("ID", task.ID).Error("Can't register task")
+				} else if outcome == service.RegistrationUnchanged {
+					summary.unchanged++
+				} else {
+					summary.registered++
 				}
 			} else {
+				summary.skipped++
 				log.WithFields(log.Fields{
 					"APP": app.ID, "ID": task.ID,
 				}).Debug("Task is not healthy. Not Registering")
+				s.failTaskHealth(task.ID)
 			}
 		}
 	}
 }
 
-func (s Sync) deregisterConsulServicesThatAreNotInMarathonApps(apps []*apps.App, services []*consul.CatalogService) {
-	//	TODO: Change it to map implementation
-	for _, instance := range services {
-		found := false
-		for _, app := range apps {
-			for _, task := range app.Tasks {
-				found = found || instance.ServiceID == task.ID
-			}
+func (s *Sync) failTaskHealth(taskId string) {
+	if err := s.service.UpdateTaskHealth(taskId, false); err != nil {
+		log.WithError(err).WithField("ID", taskId).Debug("Can't mark task unhealthy")
+	}
+}
+
+// Service IDs of all tasks of Marathon apps
+func (s *Sync) liveServiceIds(apps []*apps.App) []string {
+	var serviceIds []string
+	for _, app := range apps {
+		for _, task := range app.Tasks {
+			serviceIds = append(serviceIds, s.service.ServiceId(task))
 		}
-		if !found {
-			err := s.service.Deregister(instance.ServiceID, instance.Node)
-			if err != nil {
-				log.WithError(err).WithField("ID", instance.ServiceID).Error("Can't deregister service")
-			}
+	}
+	return serviceIds
+}
+
+func (s Sync) deregisterConsulServicesThatAreNotInMarathonApps(serviceIds []string, services []*consul.CatalogService, summary *syncSummary) {
+	for _, instance := range service.OrphanedServices(services, serviceIds) {
+		outcome, err := s.service.Deregister(instance.ServiceID, instance.Node)
+		if err != nil {
+			summary.failed++
+			log.WithError(err).WithField("ID", instance.ServiceID).Error("Can't deregister service")
+		} else if outcome == service.DeregistrationPending {
+			summary.pending++
+		} else {
+			summary.deregistered++
 		}
 	}
 }
@@ -1,8 +1,11 @@
 package sync
 
 import (
+	"errors"
+	"github.com/allegro/marathon-consul/apps"
 	"github.com/allegro/marathon-consul/consul"
 	"github.com/allegro/marathon-consul/marathon"
+	"github.com/allegro/marathon-consul/tasks"
 	. "github.com/allegro/marathon-consul/utils"
 	consulapi "github.com/hashicorp/consul/api"
 	"github.com/stretchr/testify/assert"
@@ -31,7 +34,8 @@ func TestSyncJob(t *testing.T) {
 }
 
 type ConsulServicesMock struct {
-	registrations map[string]int
+	registrations  map[string]int
+	liveServiceIds []string
 }
 
 func newConsulServicesMock() *ConsulServicesMock {
@@ -49,12 +53,37 @@ func (c *ConsulServicesMock) Register(service *consulapi.AgentServiceRegistratio
 	return nil
 }
 
+func (c *ConsulServicesMock) RegisterTask(task tasks.Task, app *apps.App) (consul.RegisterOutcome, error) {
+	c.Register(consul.MarathonTaskToConsulService(task, app.HealthChecks, app.Labels))
+	return consul.Registered, nil
+}
+
+func (c *ConsulServicesMock) IsManaged(app *apps.App) bool {
+	return app.Labels["consul"] == "true"
+}
+
+func (c *ConsulServicesMock) ServiceId(task tasks.Task) string {
+	return consul.ServiceId(task.ID)
+}
+
+func (c *ConsulServicesMock) TaskServiceId(task tasks.Task) string {
+	return c.ServiceId(task)
+}
+
+func (c *ConsulServicesMock) UpdateTaskHealth(taskId string, healthy bool) error {
+	return nil
+}
+
+func (c *ConsulServicesMock) PruneRegistrations(liveServiceIds []string) {
+	c.liveServiceIds = liveServiceIds
+}
+
 func (c *ConsulServicesMock) RegistrationsCount(instanceId string) int {
 	return c.registrations[instanceId]
 }
 
-func (c *ConsulServicesMock) Deregister(serviceId string, agent string) error {
-	return nil
+func (c *ConsulServicesMock) Deregister(serviceId string, agent string) (consul.DeregisterOutcome, error) {
+	return consul.Deregistered, nil
 }
 
 func TestSyncAppsFromMarathonToConsul(t *testing.T) {
@@ -122,3 +151,64 @@ func TestSyncOnlyHealthyServices(t *testing.T) {
 		assert.NotEqual(t, "app3-all-unhealthy", s.ServiceName)
 	}
 }
+
+type scriptedConsul struct {
+	*consul.ConsulStub
+	failingApp       *apps.App
+	unchangedApp     *apps.App
+	pendingServiceId string
+}
+
+func (c scriptedConsul) Deregister(serviceId string, agent string) (consul.DeregisterOutcome, error) {
+	if serviceId == c.pendingServiceId {
+		return consul.DeregistrationPending, nil
+	}
+	return c.ConsulStub.Deregister(serviceId, agent)
+}
+
+func (c scriptedConsul) RegisterTask(task tasks.Task, app *apps.App) (consul.RegisterOutcome, error) {
+	switch app {
+	case c.failingApp:
+		return consul.RegistrationFailed, errors.New("registration failed")
+	case c.unchangedApp:
+		return consul.RegistrationUnchanged, nil
+	}
+	return c.ConsulStub.RegisterTask(task, app)
+}
+
+func TestSyncPrunesRegistrationsOfTasksMissingFromMarathon(t *testing.T) {
+	// given
+	app := ConsulApp("app1", 2)
+	services := newConsulServicesMock()
+	marathonSync := New(marathon.MarathonerStubForApps(app), services)
+
+	// when
+	marathonSync.SyncServices()
+
+	// then
+	assert.Equal(t, []string{consul.ServiceId(app.Tasks[0].ID), consul.ServiceId(app.Tasks[1].ID)}, services.liveServiceIds)
+}
+
+func TestSyncSummaryCountsOutcomes(t *testing.T) {
+	// given
+	stub := consul.NewConsulStub()
+	rampedApp := ConsulApp("app5-ramped", 1)
+	New(marathon.MarathonerStubForApps(ConsulApp("app0-removed", 1), rampedApp), stub).SyncServices()
+
+	failingApp := ConsulApp("app3-failing", 1)
+	unchangedApp := ConsulApp("app4-unchanged", 2)
+	marathoner := marathon.MarathonerStubForApps(
+		ConsulApp("app1", 2),
+		ConsulAppWithUnhealthyInstances("app2-one-unhealthy", 2, 1),
+		failingApp,
+		unchangedApp,
+	)
+	marathonSync := New(marathoner, scriptedConsul{stub, failingApp, unchangedApp, consul.ServiceId(rampedApp.Tasks[0].ID)})
+
+	// when
+	summary, err := marathonSync.syncServices()
+
+	// then
+	assert.NoError(t, err)
+	assert.Equal(t, &syncSummary{registered: 3, unchanged: 2, deregistered: 1, pending: 1, skipped: 1, failed: 1}, summary)
+}
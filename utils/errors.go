@@ -0,0 +1,18 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Merges errors into one listing all their messages, nil when there are no errors
+func MergeErrorsOrNil(errors []error, description string) error {
+	if len(errors) == 0 {
+		return nil
+	}
+	messages := make([]string, 0, len(errors))
+	for _, err := range errors {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Errorf("%d errors occurred %s: %s", len(errors), description, strings.Join(messages, "; "))
+}
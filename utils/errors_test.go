@@ -0,0 +1,15 @@
+package utils
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMergeErrorsOrNil(t *testing.T) {
+	t.Parallel()
+	assert.NoError(t, MergeErrorsOrNil(nil, "deregistering services"))
+
+	err := MergeErrorsOrNil([]error{errors.New("first"), errors.New("second")}, "deregistering services")
+	assert.EqualError(t, err, "2 errors occurred deregistering services: first; second")
+}
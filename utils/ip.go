@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+)
+
+const (
+	FirstAddress         = "first"
+	LastAddress          = "last"
+	PreferPrivateAddress = "prefer-private"
+	PreferPublicAddress  = "prefer-public"
+)
+
+var AddressSelections = []string{FirstAddress, LastAddress, PreferPrivateAddress, PreferPublicAddress}
+
+var privateNetworks = []*net.IPNet{
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+}
+
+// stubbed out for testing
+var lookupIP = net.LookupIP
+
+// Resolves host to one of its IPv4 addresses picked with given selection,
+// IP literals (including IPv6 ones) are returned without lookup
+func HostToIPv4(host string, selection string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+	ips, err := lookupIP(host)
+	if err != nil {
+		return "", err
+	}
+	var ipv4s []net.IP
+	for _, ip := range ips {
+		if ipv4 := ip.To4(); ipv4 != nil {
+			ipv4s = append(ipv4s, ipv4)
+		}
+	}
+	if len(ipv4s) == 0 {
+		return "", fmt.Errorf("No IPv4 address found for %s", host)
+	}
+
+	switch selection {
+	case LastAddress:
+		return ipv4s[len(ipv4s)-1].String(), nil
+	case PreferPrivateAddress:
+		return preferred(ipv4s, true).String(), nil
+	case PreferPublicAddress:
+		return preferred(ipv4s, false).String(), nil
+	default:
+		return ipv4s[0].String(), nil
+	}
+}
+
+func preferred(ips []net.IP, private bool) net.IP {
+	for _, ip := range ips {
+		if isPrivate(ip) == private {
+			return ip
+		}
+	}
+	return ips[0]
+}
+
+func isPrivate(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
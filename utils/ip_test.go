@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func stubLookupIP(ips ...string) {
+	lookupIP = func(host string) ([]net.IP, error) {
+		var result []net.IP
+		for _, ip := range ips {
+			result = append(result, net.ParseIP(ip))
+		}
+		return result, nil
+	}
+}
+
+func TestHostToIPv4Selection(t *testing.T) {
+	stubLookupIP("203.0.113.7", "fe80::1", "10.1.2.3", "192.168.0.4", "198.51.100.9")
+
+	tests := []struct {
+		selection string
+		expected  string
+	}{
+		{FirstAddress, "203.0.113.7"},
+		{"", "203.0.113.7"},
+		{LastAddress, "198.51.100.9"},
+		{PreferPrivateAddress, "10.1.2.3"},
+		{PreferPublicAddress, "203.0.113.7"},
+	}
+
+	for _, tt := range tests {
+		ip, err := HostToIPv4("multi-homed.example.com", tt.selection)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expected, ip, tt.selection)
+	}
+}
+
+func TestHostToIPv4PreferenceFallsBackToFirstAddress(t *testing.T) {
+	stubLookupIP("10.1.2.3", "10.1.2.4")
+
+	ip, err := HostToIPv4("private.example.com", PreferPublicAddress)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "10.1.2.3", ip)
+}
+
+func TestHostToIPv4WithoutIPv4Addresses(t *testing.T) {
+	stubLookupIP("fe80::1")
+
+	_, err := HostToIPv4("ipv6.example.com", FirstAddress)
+
+	assert.Error(t, err)
+}
+
+func TestHostToIPv4LookupError(t *testing.T) {
+	lookupIP = func(host string) ([]net.IP, error) { return nil, errors.New("no such host") }
+
+	_, err := HostToIPv4("unknown.example.com", FirstAddress)
+
+	assert.Error(t, err)
+}
+
+func TestHostToIPv4ReturnsIPLiteralsWithoutLookup(t *testing.T) {
+	lookupIP = func(host string) ([]net.IP, error) {
+		t.Errorf("Unexpected lookup of %s", host)
+		return nil, errors.New("unexpected lookup")
+	}
+
+	for _, host := range []string{"10.1.2.3", "2001:db8::1"} {
+		ip, err := HostToIPv4(host, PreferPublicAddress)
+		assert.NoError(t, err)
+		assert.Equal(t, host, ip)
+	}
+}
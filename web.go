@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
@@ -18,6 +19,18 @@ func HealthHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "OK")
 }
 
+// Serves effective configuration as JSON, it should have secrets redacted
+func ConfigHandler(config interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(config); err != nil {
+			log.WithError(err).Error("Unable to encode configuration")
+		}
+	}
+}
+
 type ForwardHandler struct {
 	service  service.ConsulServices
 	marathon marathon.Marathoner
@@ -76,7 +89,7 @@ func (fh *ForwardHandler) handleTerminationEvent(w http.ResponseWriter, body []b
 	}
 
 	for _, task := range tasks {
-		err = fh.service.Deregister(task.ID, task.Host)
+		_, err = fh.service.Deregister(fh.service.TaskServiceId(*task), task.Host)
 		if err != nil {
 			log.WithField("ID", task.ID).WithError(err).Error("There was a problem deregistering task")
 		}
@@ -102,6 +115,9 @@ func (fh *ForwardHandler) handleHealthStatusEvent(w http.ResponseWriter, body []
 
 	if !taskHealthChange.Alive {
 		log.WithField("ID", taskHealthChange.ID).Debug("Task is not alive. Not registering")
+		if err := fh.service.UpdateTaskHealth(taskHealthChange.ID, false); err != nil {
+			log.WithField("ID", taskHealthChange.ID).WithError(err).Debug("Can't mark task unhealthy")
+		}
 		return
 	}
 
@@ -114,7 +130,7 @@ func (fh *ForwardHandler) handleHealthStatusEvent(w http.ResponseWriter, body []
 		return
 	}
 
-	if value, ok := app.Labels["consul"]; !ok || value != "true" {
+	if !fh.service.IsManaged(app) {
 		log.WithFields(log.Fields{
 			"APP": appId,
 			"ID":  taskHealthChange.ID,
@@ -122,9 +138,6 @@ func (fh *ForwardHandler) handleHealthStatusEvent(w http.ResponseWriter, body []
 		return
 	}
 
-	healthCheck := app.HealthChecks
-	labels := app.Labels
-
 	task, err := findTaskById(taskHealthChange.ID, tasks)
 	if err != nil {
 		log.WithField("ID", taskHealthChange.ID).WithError(err).Error("Task not found")
@@ -132,7 +145,7 @@ func (fh *ForwardHandler) handleHealthStatusEvent(w http.ResponseWriter, body []
 	}
 
 	if service.IsTaskHealthy(task.HealthCheckResults) {
-		err := fh.service.Register(service.MarathonTaskToConsulService(task, healthCheck, labels))
+		_, err := fh.service.RegisterTask(task, app)
 		if err != nil {
 			log.WithField("ID", task.ID).WithError(err).Error("There was a problem registering task")
 		}
@@ -162,7 +175,7 @@ func (fh *ForwardHandler) handleStatusEvent(w http.ResponseWriter, body []byte)
 
 	switch task.TaskStatus {
 	case "TASK_FINISHED", "TASK_FAILED", "TASK_KILLED", "TASK_LOST":
-		fh.service.Deregister(task.ID, task.Host)
+		fh.service.Deregister(fh.service.TaskServiceId(*task), task.Host)
 	case "TASK_STAGING", "TASK_STARTING", "TASK_RUNNING":
 		log.WithFields(log.Fields{
 			"taskStatus": task.TaskStatus,
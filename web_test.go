@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"github.com/allegro/marathon-consul/config"
 	"github.com/allegro/marathon-consul/consul"
 	"github.com/allegro/marathon-consul/events"
 	"github.com/allegro/marathon-consul/marathon"
@@ -26,6 +27,25 @@ func TestHealthHandler(t *testing.T) {
 	assert.Equal(t, "OK\n", recorder.Body.String())
 }
 
+func TestConfigHandlerServesRedactedConfig(t *testing.T) {
+	t.Parallel()
+	// given
+	cfg := config.Config{}
+	cfg.Consul.Token = "secret-token"
+	cfg.Marathon.Password = "secret-password"
+	req, _ := http.NewRequest("GET", "/config", nil)
+
+	// when
+	recorder := httptest.NewRecorder()
+	ConfigHandler(cfg.Redacted())(recorder, req)
+
+	// then
+	assert.Equal(t, 200, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), consul.Redacted)
+	assert.NotContains(t, recorder.Body.String(), "secret-token")
+	assert.NotContains(t, recorder.Body.String(), "secret-password")
+}
+
 func TestForwardHandler_NotHandleUnknownEventType(t *testing.T) {
 	t.Parallel()
 	// given